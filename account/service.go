@@ -0,0 +1,144 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/article"
+	"github.com/zulfikarrosadi/go-blog-api/auth"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// PURGE_INTERVAL is how often accounts whose grace period ended are looked
+// for, a deletion can happen this much later than it was scheduled for.
+const PURGE_INTERVAL = time.Hour
+
+// AccountService deletes accounts together with their content, it lives
+// outside the auth and article packages because it needs both.
+type AccountService interface {
+	PurgeScheduledDeletions(context.Context) (int, error)
+	RunPurger(context.Context)
+}
+
+type AccountServiceImpl struct {
+	db                *sql.DB
+	authRepository    auth.AuthRepository
+	articleRepository article.ArticleRepository
+}
+
+func NewAccountService(
+	db *sql.DB, authRepository auth.AuthRepository, articleRepository article.ArticleRepository,
+) *AccountServiceImpl {
+	return &AccountServiceImpl{
+		db:                db,
+		authRepository:    authRepository,
+		articleRepository: articleRepository,
+	}
+}
+
+// PurgeScheduledDeletions deletes every account whose grace period has
+// ended and returns how many were deleted. A failing account does not stop
+// the others, it is tried again on the next run.
+func (asi *AccountServiceImpl) PurgeScheduledDeletions(ctx context.Context) (int, error) {
+	deletions, err := asi.authRepository.FindScheduledDeletions(time.Now(), ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := range deletions {
+		err = asi.deleteAccount(&deletions[i], ctx)
+		if errors.Is(err, auth.ErrDeletionCancelled) {
+			continue
+		}
+		if err != nil {
+			lib.ErrorLog("purge_scheduled_deletions_service", "failed to delete account", err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteAccount handles the articles and then removes the user in one
+// transaction, either all of it happens or none of it. The outcome is
+// recorded in the audit log.
+func (asi *AccountServiceImpl) deleteAccount(deletion *auth.ScheduledDeletion, ctx context.Context) (err error) {
+	defer func() {
+		if errors.Is(err, auth.ErrDeletionCancelled) {
+			return
+		}
+		event := &auth.AuditEvent{
+			Event:  auth.AUDIT_ACCOUNT_DELETE,
+			UserId: deletion.UserId,
+			Detail: "articles " + deletion.Articles,
+		}
+		var response *web.Response
+		if err != nil {
+			response = &web.Response{
+				Status: web.STATUS_FAIL,
+				Error: web.Error{
+					Message: err.Error(),
+				},
+			}
+		}
+		auth.RecordAuditEvent(asi.authRepository, event, response, ctx)
+	}()
+
+	tx, err := asi.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a cancellation that comes in now waits for the transaction
+	err = asi.authRepository.LockScheduledDeletion(tx, deletion.UserId, ctx)
+	if err != nil {
+		return err
+	}
+
+	switch deletion.Articles {
+	case auth.DELETION_ARTICLES_REASSIGN:
+		placeholderId, err := asi.authRepository.FindPlaceholderUserId(tx, ctx)
+		if err != nil {
+			return err
+		}
+		err = asi.articleRepository.ReassignArticles(tx, deletion.UserId, placeholderId, ctx)
+		if err != nil {
+			return err
+		}
+	case auth.DELETION_ARTICLES_DELETE:
+		err = asi.articleRepository.DeleteArticlesByAuthor(tx, deletion.UserId, ctx)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown article action " + deletion.Articles)
+	}
+
+	err = asi.authRepository.DeleteUser(tx, deletion.UserId, ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RunPurger purges scheduled deletions every PURGE_INTERVAL until ctx is
+// done.
+func (asi *AccountServiceImpl) RunPurger(ctx context.Context) {
+	ticker := time.NewTicker(PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if _, err := asi.PurgeScheduledDeletions(ctx); err != nil {
+			lib.ErrorLog("run_purger_service", "failed to purge scheduled deletions", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
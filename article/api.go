@@ -91,7 +91,7 @@ func (aa *ArticleApiImpl) UpdateArticle(c echo.Context) error {
 
 func (aa *ArticleApiImpl) GetUserLoginInfo(c echo.Context) context.Context {
 	accessToken := c.Get("accessToken").(auth.AccessToken)
-	ctx := context.WithValue(c.Request().Context(), "accessToken", accessToken)
+	ctx := context.WithValue(auth.WithClientInfo(c), "accessToken", accessToken)
 
 	return ctx
 }
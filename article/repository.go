@@ -16,6 +16,8 @@ type ArticleRepository interface {
 	CreateArticle(*CreateArticleRequest, context.Context) (int64, error)
 	DeleteArticleById(int, context.Context) error
 	UpdateArticleById(int, *UpdateArticleRequest, context.Context) error
+	DeleteArticlesByAuthor(*sql.Tx, int64, context.Context) error
+	ReassignArticles(*sql.Tx, int64, int64, context.Context) error
 }
 
 type ArticleRepositoryImpl struct {
@@ -74,8 +76,17 @@ func (as *ArticleRepositoryImpl) CreateArticle(data *CreateArticleRequest, ctx c
 func (as *ArticleRepositoryImpl) DeleteArticleById(id int, ctx context.Context) error {
 	q := "DELETE FROM articles WHERE id = ? AND author = ?"
 	user := ctx.Value("accessToken").(auth.AccessToken)
-	result, err := as.DB.ExecContext(ctx, q, id, user.UserId)
-	deletedArticle, _ := result.RowsAffected()
+	args := []any{id, user.UserId}
+	if user.HasPermission(auth.PERMISSION_MODERATE_ARTICLES) {
+		q = "DELETE FROM articles WHERE id = ?"
+		args = args[:1]
+	}
+
+	result, err := as.DB.ExecContext(ctx, q, args...)
+	var deletedArticle int64
+	if err == nil {
+		deletedArticle, _ = result.RowsAffected()
+	}
 
 	fmt.Println("deleted article is:", deletedArticle)
 	if err != nil || deletedArticle < 1 {
@@ -89,9 +100,17 @@ func (as *ArticleRepositoryImpl) DeleteArticleById(id int, ctx context.Context)
 func (as *ArticleRepositoryImpl) UpdateArticleById(id int, data *UpdateArticleRequest, ctx context.Context) error {
 	user := ctx.Value("accessToken").(auth.AccessToken)
 	q := "UPDATE articles SET title = ?, content = ?, slug = ? WHERE id = ? AND author = ?"
+	args := []any{data.Title, data.Content, data.Slug, data.Id, user.UserId}
+	if user.HasPermission(auth.PERMISSION_MODERATE_ARTICLES) {
+		q = "UPDATE articles SET title = ?, content = ?, slug = ? WHERE id = ?"
+		args = args[:4]
+	}
 
-	result, err := as.DB.ExecContext(ctx, q, data.Title, data.Content, data.Slug, data.Id, user.UserId)
-	updatedArticle, _ := result.RowsAffected()
+	result, err := as.DB.ExecContext(ctx, q, args...)
+	var updatedArticle int64
+	if err == nil {
+		updatedArticle, _ = result.RowsAffected()
+	}
 
 	fmt.Println("updated article: ", updatedArticle)
 	if err != nil || updatedArticle < 1 {
@@ -101,3 +120,27 @@ func (as *ArticleRepositoryImpl) UpdateArticleById(id int, data *UpdateArticleRe
 
 	return nil
 }
+
+// DeleteArticlesByAuthor runs as part of tx, it is used when the author
+// deletes their account.
+func (as *ArticleRepositoryImpl) DeleteArticlesByAuthor(tx *sql.Tx, authorId int64, ctx context.Context) error {
+	q := "DELETE FROM articles WHERE author = ?"
+	_, err := tx.ExecContext(ctx, q, authorId)
+	if err != nil {
+		lib.ValidateErrorV2("delete_articles_by_author_repo", err)
+		return errors.New("failed to delete articles")
+	}
+	return nil
+}
+
+// ReassignArticles hands every article of fromAuthorId to toAuthorId as part
+// of tx.
+func (as *ArticleRepositoryImpl) ReassignArticles(tx *sql.Tx, fromAuthorId int64, toAuthorId int64, ctx context.Context) error {
+	q := "UPDATE articles SET author = ? WHERE author = ?"
+	_, err := tx.ExecContext(ctx, q, toAuthorId, fromAuthorId)
+	if err != nil {
+		lib.ValidateErrorV2("reassign_articles_repo", err)
+		return errors.New("failed to reassign articles")
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/zulfikarrosadi/go-blog-api/auth"
 	"github.com/zulfikarrosadi/go-blog-api/lib"
 	"github.com/zulfikarrosadi/go-blog-api/web"
 )
@@ -34,14 +35,16 @@ type ArticleService interface {
 
 type ArticleServiceImpl struct {
 	ArticleRepository
-	v *validator.Validate
+	auditLog auth.AuditLog
+	v        *validator.Validate
 }
 
 func NewArticleService(
-	articleRepository ArticleRepository, v *validator.Validate,
+	articleRepository ArticleRepository, auditLog auth.AuditLog, v *validator.Validate,
 ) *ArticleServiceImpl {
 	return &ArticleServiceImpl{
 		ArticleRepository: articleRepository,
+		auditLog:          auditLog,
 		v:                 v,
 	}
 }
@@ -193,7 +196,9 @@ func (as *ArticleServiceImpl) CreateArticle(data *CreateArticleRequest, ctx cont
 	}
 }
 
-func (as *ArticleServiceImpl) DeleteArticleById(id int, ctx context.Context) web.Response {
+func (as *ArticleServiceImpl) DeleteArticleById(id int, ctx context.Context) (response web.Response) {
+	defer func() { as.audit(auth.AUDIT_ARTICLE_DELETE, id, &response, ctx) }()
+
 	errorChannel := make(chan error)
 	defer close(errorChannel)
 
@@ -214,7 +219,9 @@ func (as *ArticleServiceImpl) DeleteArticleById(id int, ctx context.Context) web
 	}
 }
 
-func (as *ArticleServiceImpl) UpdateArticleById(articleId int, data *UpdateArticleRequest, ctx context.Context) web.Response {
+func (as *ArticleServiceImpl) UpdateArticleById(articleId int, data *UpdateArticleRequest, ctx context.Context) (response web.Response) {
+	defer func() { as.audit(auth.AUDIT_ARTICLE_UPDATE, articleId, &response, ctx) }()
+
 	err := as.ArticleRepository.UpdateArticleById(articleId, data, ctx)
 	if err != nil {
 		return web.Response{
@@ -231,6 +238,22 @@ func (as *ArticleServiceImpl) UpdateArticleById(articleId int, data *UpdateArtic
 	}
 }
 
+// audit records who changed the article, when an admin impersonates the
+// author they are recorded as the actor.
+func (as *ArticleServiceImpl) audit(event string, articleId int, response *web.Response, ctx context.Context) {
+	accessToken := ctx.Value("accessToken").(auth.AccessToken)
+	auditEvent := &auth.AuditEvent{
+		Event:    event,
+		UserId:   accessToken.UserId,
+		Username: accessToken.Username,
+		Detail:   "article " + strconv.Itoa(articleId),
+	}
+	if accessToken.Actor != nil {
+		auditEvent.ActorId = accessToken.Actor.UserId
+	}
+	auth.RecordAuditEvent(as.auditLog, auditEvent, response, ctx)
+}
+
 func createSlug(title string, timestamp int64) string {
 	splitedTitle := strings.Split(strings.Trim(title, " "), " ")
 	slug := strings.ToLower(strings.Join(splitedTitle, "-"))
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// ScheduleAccountDeletion only marks the account, it is deleted by the
+// account package once the grace period has passed. The user stays signed in
+// so they can change their mind.
+func (asi *AuthServiceImpl) ScheduleAccountDeletion(
+	accessToken *AccessToken, data *DeleteAccountRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_ACCOUNT_DELETION_SCHEDULE, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	// accounts created through an identity provider have no password, the
+	// session is all they can prove
+	if user.Password != "" {
+		key := "delete_account:" + strconv.FormatInt(user.Id, 10)
+		errorResponse := asi.throttleAttempts(key, func() error {
+			if !asi.config.PasswordHasher.Verify(user.Password, data.Password) {
+				return errors.New("password is incorrect")
+			}
+			return nil
+		})
+		if errorResponse != nil {
+			return errorResponse
+		}
+	}
+
+	deletion := &ScheduledDeletion{
+		UserId:      user.Id,
+		Articles:    data.Articles,
+		ScheduledAt: time.Now().Add(asi.config.AccountDeletionGracePeriod),
+	}
+	err = asi.AuthRepository.ScheduleUserDeletion(deletion, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	if user.Email != "" {
+		go asi.sendMail("schedule_account_deletion_service", lib.Mail{
+			To:      user.Email,
+			Subject: "Your account will be deleted",
+			Body: "Hi " + user.Username + ",\r\n\r\n" +
+				"Your account will be deleted on " + deletion.ScheduledAt.UTC().Format(time.RFC1123) + ". " +
+				"Until then you can sign in and cancel the deletion.\r\n\r\n" +
+				"If it was not you, sign in, cancel the deletion and change your password.",
+		})
+	}
+
+	user.DeletionScheduledAt = &deletion.ScheduledAt
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusAccepted,
+		Data:   user,
+	}
+}
+
+func (asi *AuthServiceImpl) CancelAccountDeletion(accessToken *AccessToken, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_ACCOUNT_DELETION_CANCEL, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	err := asi.AuthRepository.CancelUserDeletion(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusNoContent,
+	}
+}
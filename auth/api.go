@@ -1,29 +1,70 @@
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
+	"context"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/zulfikarrosadi/go-blog-api/web"
 )
 
 type AuthHandler interface {
 	SignInHandler(echo.Context) error
 	SignUpHandler(echo.Context) error
 	RefreshTokenHandler(echo.Context) error
+	SignOutHandler(echo.Context) error
+	SignOutEverywhereHandler(echo.Context) error
+	JWKSHandler(echo.Context) error
+	UpdateUserRoleHandler(echo.Context) error
+	RequestPasswordResetHandler(echo.Context) error
+	ResetPasswordHandler(echo.Context) error
+	VerifyEmailHandler(echo.Context) error
+	ResendEmailVerificationHandler(echo.Context) error
+	ChangeEmailHandler(echo.Context) error
+	SignInTwoFactorHandler(echo.Context) error
+	EnrollTotpHandler(echo.Context) error
+	ConfirmTotpHandler(echo.Context) error
+	DisableTotpHandler(echo.Context) error
+	GetSessionsHandler(echo.Context) error
+	RevokeSessionHandler(echo.Context) error
+	OIDCSignInHandler(echo.Context) error
+	OIDCLinkHandler(echo.Context) error
+	OIDCCallbackHandler(echo.Context) error
+	CreatePersonalAccessTokenHandler(echo.Context) error
+	GetPersonalAccessTokensHandler(echo.Context) error
+	RevokePersonalAccessTokenHandler(echo.Context) error
+	GetCurrentUserHandler(echo.Context) error
+	UpdateProfileHandler(echo.Context) error
+	ChangePasswordHandler(echo.Context) error
+	DeleteAccountHandler(echo.Context) error
+	CancelAccountDeletionHandler(echo.Context) error
+	GetUsersHandler(echo.Context) error
+	GetUserHandler(echo.Context) error
+	SuspendUserHandler(echo.Context) error
+	UnsuspendUserHandler(echo.Context) error
+	SignOutUserHandler(echo.Context) error
+	GetAuditEventsHandler(echo.Context) error
+	RequestMagicLinkHandler(echo.Context) error
+	IntrospectTokenHandler(echo.Context) error
+	ImpersonateUserHandler(echo.Context) error
+	MagicLinkSignInHandler(echo.Context) error
+	ExportAuditEventsHandler(echo.Context) error
 }
 
 type AuthHandlerImpl struct {
 	AuthService
+	keyRing *KeyRing
+	cookies *CookieIssuer
 }
 
-func NewAuthHandler(authService AuthService) *AuthHandlerImpl {
+func NewAuthHandler(authService AuthService, keyRing *KeyRing, config Config) *AuthHandlerImpl {
 	return &AuthHandlerImpl{
 		AuthService: authService,
+		keyRing:     keyRing,
+		cookies:     config.Cookies,
 	}
 }
 
@@ -31,97 +72,476 @@ func (ahi *AuthHandlerImpl) SignInHandler(c echo.Context) error {
 	data := &UserSignInRequest{}
 	c.Bind(data)
 	accessTokenClaims, refreshTokenClaims, errorResponse :=
-		ahi.AuthService.SignIn(data, c.Request().Context())
+		ahi.AuthService.SignIn(data, WithClientInfo(c))
 
 	if errorResponse != nil {
+		if detail, ok := errorResponse.Error.Detail.(RetryAfterDetail); ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+		}
 		return c.JSON(errorResponse.Code, errorResponse)
 	}
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
 
-	tokens := CreateToken(true, accessTokenClaims, refreshTokenClaims)
+func (ahi *AuthHandlerImpl) SignInTwoFactorHandler(c echo.Context) error {
+	data := &TwoFactorSignInRequest{}
+	c.Bind(data)
+	accessTokenClaims, refreshTokenClaims, errorResponse :=
+		ahi.AuthService.SignInTwoFactor(data, WithClientInfo(c))
 
-	accessTokenCookie := &http.Cookie{
-		Name:     "accessToken",
-		Value:    tokens[0],
-		Secure:   false,
-		HttpOnly: true,
-	}
-	refreshTokenCookie := &http.Cookie{
-		Name:     "refreshToken",
-		Value:    tokens[1],
-		Secure:   false,
-		HttpOnly: true,
-		Path:     "/api/refresh",
+	if errorResponse != nil {
+		if detail, ok := errorResponse.Error.Detail.(RetryAfterDetail); ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+		}
+		return c.JSON(errorResponse.Code, errorResponse)
 	}
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
 
-	c.SetCookie(accessTokenCookie)
-	c.SetCookie(refreshTokenCookie)
-	return c.String(http.StatusOK, http.StatusText(http.StatusOK))
+func (ahi *AuthHandlerImpl) RequestMagicLinkHandler(c echo.Context) error {
+	data := &MagicLinkRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.RequestMagicLink(data, WithClientInfo(c))
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	return c.JSON(r.Code, r)
 }
 
-func (ahi *AuthHandlerImpl) SignUpHandler(c echo.Context) error {
-	data := &UserSignUpRequest{}
+func (ahi *AuthHandlerImpl) MagicLinkSignInHandler(c echo.Context) error {
+	data := &MagicLinkSignInRequest{}
 	c.Bind(data)
-	fmt.Println(data)
 	accessTokenClaims, refreshTokenClaims, errorResponse :=
-		ahi.AuthService.SignUp(data, c.Request().Context())
+		ahi.AuthService.SignInWithMagicLink(data, WithClientInfo(c))
 
 	if errorResponse != nil {
 		return c.JSON(errorResponse.Code, errorResponse)
 	}
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
 
-	tokens := CreateToken(true, accessTokenClaims, refreshTokenClaims)
-	accessTokenCookie := &http.Cookie{
-		Name:     "accessToken",
-		Value:    tokens[0],
-		Secure:   false,
-		SameSite: http.SameSiteNoneMode,
-		HttpOnly: true,
+func (ahi *AuthHandlerImpl) IntrospectTokenHandler(c echo.Context) error {
+	data := &IntrospectionRequest{}
+	c.Bind(data)
+	if clientId, clientSecret, ok := c.Request().BasicAuth(); ok {
+		data.ClientId = clientId
+		data.ClientSecret = clientSecret
+	}
+	introspection, errorResponse := ahi.AuthService.IntrospectToken(data, c.Request().Context())
+	if errorResponse != nil {
+		if errorResponse.Code == http.StatusUnauthorized {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="introspection"`)
+		}
+		return c.JSON(errorResponse.Code, errorResponse)
 	}
-	refreshTokenCookie := &http.Cookie{
-		Name:     "refreshToken",
-		Value:    tokens[1],
-		Secure:   false,
-		HttpOnly: true,
-		Path:     "/api/refresh",
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, introspection)
+}
+
+func (ahi *AuthHandlerImpl) signInResponse(c echo.Context, accessTokenClaims *AccessToken, refreshTokenClaims *RefreshToken) error {
+	tokens := ahi.keyRing.CreateToken(true, accessTokenClaims, refreshTokenClaims)
+	if wantsTokensInBody(c) {
+		return c.JSON(http.StatusOK, tokenResponse(tokens, accessTokenClaims))
 	}
 
-	c.SetCookie(accessTokenCookie)
-	c.SetCookie(refreshTokenCookie)
+	// the csrf token lives as long as the session it protects
+	refreshTokenTTL := time.Until(refreshTokenClaims.ExpiresAt.Time)
+	ahi.cookies.set(c, accessTokenCookie, tokens[0], time.Until(accessTokenClaims.ExpiresAt.Time))
+	ahi.cookies.set(c, refreshTokenCookie, tokens[1], refreshTokenTTL)
+	ahi.cookies.set(c, csrfTokenCookie, newTokenId(), refreshTokenTTL)
 	return c.String(http.StatusOK, http.StatusText(http.StatusOK))
 }
 
+func (ahi *AuthHandlerImpl) SignUpHandler(c echo.Context) error {
+	data := &UserSignUpRequest{}
+	c.Bind(data)
+	accessTokenClaims, refreshTokenClaims, errorResponse :=
+		ahi.AuthService.SignUp(data, WithClientInfo(c))
+
+	if errorResponse != nil {
+		return c.JSON(errorResponse.Code, errorResponse)
+	}
+
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
+
 func (ahi *AuthHandlerImpl) RefreshTokenHandler(c echo.Context) error {
-	refreshTokenCookie, err := c.Request().Cookie("refreshToken")
-	if err != nil {
-		fmt.Println(err)
+	var refreshToken string
+	if refreshToken = ahi.cookies.get(c, refreshTokenCookie); refreshToken == "" {
+		data := &RefreshTokenRequest{}
+		c.Bind(data)
+		refreshToken = data.RefreshToken
+	}
+	if refreshToken == "" {
 		return c.NoContent(http.StatusUnauthorized)
 	}
 
-	_, validatedRefreshToken, err := ValidateToken(refreshTokenCookie.Value, true)
-	if err != nil {
-		fmt.Println(err)
-		return c.NoContent(http.StatusUnauthorized)
+	accessTokenClaims, refreshTokenClaims, errorResponse :=
+		ahi.AuthService.RefreshToken(refreshToken, WithClientInfo(c))
+	if errorResponse != nil {
+		return c.JSON(errorResponse.Code, errorResponse)
 	}
 
-	accessTokenId := make([]byte, 10)
-	rand.Read(accessTokenId)
-	newAccessTokenClaims := AccessToken{
-		AccessTokenId: base64.URLEncoding.EncodeToString(accessTokenId)[:10],
-		UserId:        validatedRefreshToken.Id,
-		Username:      validatedRefreshToken.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 15)),
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
+
+func (ahi *AuthHandlerImpl) SignOutHandler(c echo.Context) error {
+	return ahi.signOut(c, false)
+}
+
+func (ahi *AuthHandlerImpl) SignOutEverywhereHandler(c echo.Context) error {
+	return ahi.signOut(c, true)
+}
+
+func (ahi *AuthHandlerImpl) signOut(c echo.Context, everywhere bool) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	errorResponse := ahi.AuthService.SignOut(&accessToken, everywhere, WithClientInfo(c))
+	if errorResponse != nil {
+		return c.JSON(errorResponse.Code, errorResponse)
+	}
+
+	ahi.cookies.clear(c, accessTokenCookie)
+	ahi.cookies.clear(c, refreshTokenCookie)
+	ahi.cookies.clear(c, csrfTokenCookie)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (ahi *AuthHandlerImpl) JWKSHandler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(http.StatusOK, ahi.keyRing.PublicKeys())
+}
+
+func wantsTokensInBody(c echo.Context) bool {
+	return strings.EqualFold(c.Request().Header.Get("X-Token-Delivery"), "body")
+}
+
+func tokenResponse(tokens []string, accessTokenClaims *AccessToken) web.Response {
+	return web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: TokenResponse{
+			AccessToken:  tokens[0],
+			RefreshToken: tokens[1],
+			TokenType:    "Bearer",
+			ExpiresIn:    int64(time.Until(accessTokenClaims.ExpiresAt.Time).Seconds()),
 		},
 	}
-	tokens := CreateToken(false, newAccessTokenClaims)
+}
 
-	newAccessTokenCookie := http.Cookie{
-		Name:     "accessToken",
-		Value:    tokens[0],
-		Secure:   false,
-		SameSite: http.SameSiteNoneMode,
-		HttpOnly: true,
+func (ahi *AuthHandlerImpl) UpdateUserRoleHandler(c echo.Context) error {
+	data := &UpdateUserRoleRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.UpdateUserRole(&accessToken, data, WithClientInfo(c))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) RequestPasswordResetHandler(c echo.Context) error {
+	data := &PasswordResetRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.RequestPasswordReset(data, WithClientInfo(c))
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
 	}
-	c.SetCookie(&newAccessTokenCookie)
-	return c.String(http.StatusOK, http.StatusText(http.StatusOK))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ResetPasswordHandler(c echo.Context) error {
+	data := &PasswordResetConfirmRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.ResetPassword(data, WithClientInfo(c))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) VerifyEmailHandler(c echo.Context) error {
+	data := &EmailVerificationRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.VerifyEmail(data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ResendEmailVerificationHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ResendEmailVerification(&accessToken, c.Request().Context())
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ChangeEmailHandler(c echo.Context) error {
+	data := &ChangeEmailRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ChangeEmail(&accessToken, data, WithClientInfo(c))
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	return c.JSON(r.Code, r)
+}
+
+// WithClientInfo is the request context with the ip address and user agent
+// of the client, sessions and the audit log read them from it.
+func WithClientInfo(c echo.Context) context.Context {
+	return context.WithValue(c.Request().Context(), "clientInfo", ClientInfo{
+		IpAddress: c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	})
+}
+
+func (ahi *AuthHandlerImpl) EnrollTotpHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.EnrollTotp(&accessToken, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ConfirmTotpHandler(c echo.Context) error {
+	data := &TotpCodeRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ConfirmTotp(&accessToken, data, WithClientInfo(c))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) DisableTotpHandler(c echo.Context) error {
+	data := &TotpCodeRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.DisableTotp(&accessToken, data, WithClientInfo(c))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetSessionsHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.GetSessions(&accessToken, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) RevokeSessionHandler(c echo.Context) error {
+	data := &SessionRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.RevokeSession(&accessToken, data, c.Request().Context())
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) OIDCSignInHandler(c echo.Context) error {
+	return ahi.startOIDC(c, 0)
+}
+
+func (ahi *AuthHandlerImpl) OIDCLinkHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	return ahi.startOIDC(c, accessToken.UserId)
+}
+
+func (ahi *AuthHandlerImpl) startOIDC(c echo.Context, linkUserId int64) error {
+	redirectURL, stateToken, errorResponse :=
+		ahi.AuthService.StartOIDCSignIn(c.Param("provider"), linkUserId, c.Request().Context())
+	if errorResponse != nil {
+		return c.JSON(errorResponse.Code, errorResponse)
+	}
+
+	ahi.cookies.set(c, oidcStateCookie, stateToken, OIDC_STATE_TTL)
+	return c.Redirect(http.StatusFound, redirectURL)
+}
+
+func (ahi *AuthHandlerImpl) OIDCCallbackHandler(c echo.Context) error {
+	stateToken := ahi.cookies.get(c, oidcStateCookie)
+	ahi.cookies.clear(c, oidcStateCookie)
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		return c.JSON(http.StatusUnauthorized, web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusUnauthorized,
+			Error: web.Error{
+				Message: "sign in was cancelled or rejected by the identity provider",
+				Detail:  providerError,
+			},
+		})
+	}
+
+	accessTokenClaims, refreshTokenClaims, errorResponse := ahi.AuthService.FinishOIDCSignIn(
+		c.Param("provider"), c.QueryParam("code"), c.QueryParam("state"), stateToken, WithClientInfo(c),
+	)
+	if errorResponse != nil {
+		return c.JSON(errorResponse.Code, errorResponse)
+	}
+	return ahi.signInResponse(c, accessTokenClaims, refreshTokenClaims)
+}
+
+func (ahi *AuthHandlerImpl) CreatePersonalAccessTokenHandler(c echo.Context) error {
+	data := &CreatePersonalAccessTokenRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.CreatePersonalAccessToken(&accessToken, data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetPersonalAccessTokensHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.GetPersonalAccessTokens(&accessToken, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) RevokePersonalAccessTokenHandler(c echo.Context) error {
+	data := &PersonalAccessTokenRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.RevokePersonalAccessToken(&accessToken, data, c.Request().Context())
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetCurrentUserHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.GetCurrentUser(&accessToken, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) UpdateProfileHandler(c echo.Context) error {
+	data := &UpdateProfileRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.UpdateProfile(&accessToken, data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ChangePasswordHandler(c echo.Context) error {
+	data := &ChangePasswordRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ChangePassword(&accessToken, data, WithClientInfo(c))
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) DeleteAccountHandler(c echo.Context) error {
+	data := &DeleteAccountRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ScheduleAccountDeletion(&accessToken, data, WithClientInfo(c))
+	if detail, ok := r.Error.Detail.(RetryAfterDetail); ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) CancelAccountDeletionHandler(c echo.Context) error {
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.CancelAccountDeletion(&accessToken, WithClientInfo(c))
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetUsersHandler(c echo.Context) error {
+	data := &UserListRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.GetUsers(data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetUserHandler(c echo.Context) error {
+	data := &UserRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.GetUser(data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) SuspendUserHandler(c echo.Context) error {
+	data := &SuspendUserRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.SuspendUser(&accessToken, data, WithClientInfo(c))
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) UnsuspendUserHandler(c echo.Context) error {
+	data := &UserRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.UnsuspendUser(&accessToken, data, WithClientInfo(c))
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) SignOutUserHandler(c echo.Context) error {
+	data := &UserRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.SignOutUser(&accessToken, data, WithClientInfo(c))
+	if r.Code == http.StatusNoContent {
+		return c.NoContent(r.Code)
+	}
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) ImpersonateUserHandler(c echo.Context) error {
+	data := &ImpersonateUserRequest{}
+	c.Bind(data)
+	accessToken := c.Get("accessToken").(AccessToken)
+	r := ahi.AuthService.ImpersonateUser(&accessToken, data, WithClientInfo(c))
+	return c.JSON(r.Code, r)
+}
+
+func (ahi *AuthHandlerImpl) GetAuditEventsHandler(c echo.Context) error {
+	data := &AuditEventListRequest{}
+	c.Bind(data)
+	r := ahi.AuthService.GetAuditEvents(data, c.Request().Context())
+	return c.JSON(r.Code, r)
+}
+
+// ExportAuditEventsHandler streams the events instead of building the whole
+// export in memory, once the first event is written a failure can only cut
+// the download short.
+func (ahi *AuthHandlerImpl) ExportAuditEventsHandler(c echo.Context) error {
+	data := &AuditEventListRequest{}
+	c.Bind(data)
+	w := &ndjsonDownload{response: c.Response(), filename: "audit-events.ndjson"}
+	r := ahi.AuthService.ExportAuditEvents(data, w, c.Request().Context())
+	if r == nil {
+		// nothing matched, the download is just empty
+		w.start()
+		return nil
+	}
+	if w.started {
+		return nil
+	}
+	return c.JSON(r.Code, r)
+}
+
+// ndjsonDownload only sends the download headers with the first write, so
+// an error found before anything was written can still be sent as json.
+type ndjsonDownload struct {
+	response *echo.Response
+	filename string
+	started  bool
+}
+
+func (nd *ndjsonDownload) start() {
+	if nd.started {
+		return
+	}
+	nd.started = true
+	nd.response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	nd.response.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+nd.filename+`"`)
+	nd.response.WriteHeader(http.StatusOK)
+}
+
+func (nd *ndjsonDownload) Write(p []byte) (int, error) {
+	nd.start()
+	return nd.response.Write(p)
 }
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const (
+	AUDIT_OUTCOME_SUCCESS = "success"
+	AUDIT_OUTCOME_FAILURE = "failure"
+)
+
+const (
+	AUDIT_SIGN_UP                   = "sign_up"
+	AUDIT_SIGN_IN                   = "sign_in"
+	AUDIT_SIGN_IN_TWO_FACTOR        = "sign_in_two_factor"
+	AUDIT_SIGN_IN_OIDC              = "sign_in_oidc"
+	AUDIT_SIGN_IN_MAGIC_LINK        = "sign_in_magic_link"
+	AUDIT_OIDC_LINK                 = "oidc_link"
+	AUDIT_TOKEN_REFRESH             = "token_refresh"
+	AUDIT_SIGN_OUT                  = "sign_out"
+	AUDIT_SIGN_OUT_EVERYWHERE       = "sign_out_everywhere"
+	AUDIT_PASSWORD_CHANGE           = "password_change"
+	AUDIT_PASSWORD_RESET            = "password_reset"
+	AUDIT_EMAIL_CHANGE              = "email_change"
+	AUDIT_TOTP_ENABLE               = "totp_enable"
+	AUDIT_TOTP_DISABLE              = "totp_disable"
+	AUDIT_ACCOUNT_DELETION_SCHEDULE = "account_deletion_scheduled"
+	AUDIT_ACCOUNT_DELETION_CANCEL   = "account_deletion_cancelled"
+	AUDIT_ACCOUNT_DELETE            = "account_delete"
+	AUDIT_ROLE_CHANGE               = "role_change"
+	AUDIT_USER_SUSPEND              = "user_suspend"
+	AUDIT_USER_UNSUSPEND            = "user_unsuspend"
+	AUDIT_USER_SIGN_OUT             = "user_sign_out"
+	AUDIT_IMPERSONATION             = "impersonation"
+	AUDIT_ARTICLE_UPDATE            = "article_update"
+	AUDIT_ARTICLE_DELETE            = "article_delete"
+)
+
+// AuditLog is where RecordAuditEvent saves events, AuthRepository is one.
+type AuditLog interface {
+	SaveAuditEvent(*AuditEvent, context.Context) error
+}
+
+// audit records event with the outcome of response. Use it deferred with a
+// named response so every return of the service method is recorded.
+func (asi *AuthServiceImpl) audit(event *AuditEvent, response *web.Response, ctx context.Context) {
+	RecordAuditEvent(asi.AuthRepository, event, response, ctx)
+}
+
+// RecordAuditEvent saves event with the outcome of response, a nil response
+// or a successful one is a success and the error message of a failed one is
+// added to the detail. The client comes from a context made by
+// WithClientInfo. Failing to record is logged, it never fails the request.
+func RecordAuditEvent(auditLog AuditLog, event *AuditEvent, response *web.Response, ctx context.Context) {
+	event.Outcome = AUDIT_OUTCOME_SUCCESS
+	if response != nil && response.Status != web.STATUS_SUCCESS {
+		event.Outcome = AUDIT_OUTCOME_FAILURE
+		if event.Detail == "" {
+			event.Detail = response.Error.Message
+		} else if response.Error.Message != "" {
+			event.Detail += ": " + response.Error.Message
+		}
+	}
+	clientInfo := clientInfoFromContext(ctx)
+	event.IpAddress = clientInfo.IpAddress
+	event.UserAgent = clientInfo.UserAgent
+	event.CreatedAt = time.Now()
+
+	// the event is worth keeping even when the client went away
+	err := auditLog.SaveAuditEvent(event, context.WithoutCancel(ctx))
+	if err != nil {
+		lib.ErrorLog("audit_service", "failed to record "+event.Event+" audit event", err)
+	}
+}
+
+func (asi *AuthServiceImpl) auditEventFilter(data *AuditEventListRequest) (*AuditEventFilter, *web.Response) {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return nil, errorResponse
+	}
+	filter := &AuditEventFilter{
+		Event:   data.Event,
+		UserId:  data.UserId,
+		Outcome: data.Outcome,
+		Page:    max(data.Page, 1),
+		PerPage: data.PerPage,
+	}
+	if filter.PerPage == 0 {
+		filter.PerPage = USER_LIST_DEFAULT_PER_PAGE
+	}
+	// the validator already checked the format
+	if data.From != "" {
+		filter.From, _ = time.Parse(time.RFC3339, data.From)
+	}
+	if data.To != "" {
+		filter.To, _ = time.Parse(time.RFC3339, data.To)
+	}
+	return filter, nil
+}
+
+func (asi *AuthServiceImpl) GetAuditEvents(data *AuditEventListRequest, ctx context.Context) *web.Response {
+	filter, errorResponse := asi.auditEventFilter(data)
+	if errorResponse != nil {
+		return errorResponse
+	}
+
+	events, total, err := asi.AuthRepository.FindAuditEvents(filter, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: AuditEventListResponse{
+			Events:  events,
+			Page:    filter.Page,
+			PerPage: filter.PerPage,
+			Total:   total,
+		},
+	}
+}
+
+// ExportAuditEvents writes every matching event to w as newline delimited
+// json. Nothing is written when the filter is invalid or the events cannot
+// be read, so the returned response can still be sent instead.
+func (asi *AuthServiceImpl) ExportAuditEvents(data *AuditEventListRequest, w io.Writer, ctx context.Context) *web.Response {
+	filter, errorResponse := asi.auditEventFilter(data)
+	if errorResponse != nil {
+		return errorResponse
+	}
+
+	encoder := json.NewEncoder(w)
+	err := asi.AuthRepository.ExportAuditEvents(filter, func(event *AuditEvent) error {
+		return encoder.Encode(event)
+	}, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+)
+
+type Config struct {
+	PasswordPolicy PasswordPolicy
+	PasswordHasher *PasswordHasher
+
+	// PasswordResetURL is the page of the client app that handles the reset
+	// link, the token is appended as the token query parameter
+	PasswordResetURL      string
+	PasswordResetTokenTTL time.Duration
+	// PasswordResetMaxRequests works like MagicLinkMaxRequests
+	PasswordResetMaxRequests int
+
+	// MagicLinkURL is the page of the client app that exchanges a magic
+	// link for tokens, the token is appended as the token query parameter
+	MagicLinkURL      string
+	MagicLinkTokenTTL time.Duration
+	// MagicLinkMaxRequests is how many links can be asked for one account
+	// before it is throttled like a failed sign in, an ip address gets
+	// LoginMaxAttemptsPerIp
+	MagicLinkMaxRequests int
+
+	EmailVerificationURL      string
+	EmailVerificationTokenTTL time.Duration
+	// EmailVerificationMaxRequests is how many verification links one user
+	// gets before they have to wait
+	EmailVerificationMaxRequests int
+	// RequireVerifiedEmail stops accounts that did not confirm their email
+	// address from writing articles
+	RequireVerifiedEmail bool
+
+	// failed sign ins allowed before the username or ip address gets locked
+	// out, an ip address is shared by many users behind a nat so it gets
+	// more room
+	LoginMaxAttempts      int
+	LoginMaxAttemptsPerIp int
+	LoginBaseLockout      time.Duration
+	LoginMaxLockout       time.Duration
+
+	// TotpIssuer is the name authenticator apps show next to the account
+	TotpIssuer string
+
+	// AccountDeletionGracePeriod is how long a user can cancel the deletion
+	// of their account
+	AccountDeletionGracePeriod time.Duration
+
+	OIDCProviders map[string]*OIDCProvider
+
+	Cookies *CookieIssuer
+
+	// ImpersonationTokenTTL is how long the access token an admin gets to
+	// act as another user lasts, it cannot be refreshed
+	ImpersonationTokenTTL time.Duration
+
+	// IntrospectionClients maps the client id of every service allowed to
+	// introspect tokens to the sha256 of its secret
+	IntrospectionClients map[string]string
+}
+
+func NewConfigFromEnv() (Config, error) {
+	oidcProviders, err := NewOIDCProvidersFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	passwordHasher, err := NewPasswordHasherFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	cookies, err := NewCookieIssuerFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	introspectionClients, err := NewIntrospectionClientsFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{
+		PasswordPolicy: NewPasswordPolicyFromEnv(),
+		PasswordHasher: passwordHasher,
+
+		PasswordResetURL:         lib.GetEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password"),
+		PasswordResetTokenTTL:    lib.GetEnvDuration("PASSWORD_RESET_TOKEN_TTL", time.Minute*30),
+		PasswordResetMaxRequests: lib.GetEnvInt("PASSWORD_RESET_MAX_REQUESTS", 3),
+
+		MagicLinkURL:         lib.GetEnv("MAGIC_LINK_URL", "http://localhost:3000/magic-link"),
+		MagicLinkTokenTTL:    lib.GetEnvDuration("MAGIC_LINK_TOKEN_TTL", time.Minute*15),
+		MagicLinkMaxRequests: lib.GetEnvInt("MAGIC_LINK_MAX_REQUESTS", 3),
+
+		EmailVerificationURL:         lib.GetEnv("EMAIL_VERIFICATION_URL", "http://localhost:3000/verify-email"),
+		EmailVerificationTokenTTL:    lib.GetEnvDuration("EMAIL_VERIFICATION_TOKEN_TTL", time.Hour*24),
+		EmailVerificationMaxRequests: lib.GetEnvInt("EMAIL_VERIFICATION_MAX_REQUESTS", 3),
+		RequireVerifiedEmail:         lib.GetEnvBool("REQUIRE_VERIFIED_EMAIL", false),
+
+		LoginMaxAttempts:      lib.GetEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginMaxAttemptsPerIp: lib.GetEnvInt("LOGIN_MAX_ATTEMPTS_PER_IP", 50),
+		LoginBaseLockout:      lib.GetEnvDuration("LOGIN_BASE_LOCKOUT", time.Second*30),
+		LoginMaxLockout:       lib.GetEnvDuration("LOGIN_MAX_LOCKOUT", time.Minute*30),
+
+		TotpIssuer: lib.GetEnv("TOTP_ISSUER", "go-blog-api"),
+
+		AccountDeletionGracePeriod: lib.GetEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", time.Hour*24*30),
+
+		OIDCProviders: oidcProviders,
+
+		Cookies: cookies,
+
+		ImpersonationTokenTTL: lib.GetEnvDuration("IMPERSONATION_TOKEN_TTL", time.Minute*15),
+
+		IntrospectionClients: introspectionClients,
+	}, nil
+}
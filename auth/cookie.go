@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+)
+
+// cookieSpec describes one of the cookies the api sets, everything that
+// depends on the environment comes from CookieIssuer instead.
+type cookieSpec struct {
+	name     string
+	path     string
+	httpOnly bool
+	// sameSite overrides the configured mode when set
+	sameSite http.SameSite
+}
+
+var (
+	accessTokenCookie  = cookieSpec{name: "accessToken", path: "/", httpOnly: true}
+	refreshTokenCookie = cookieSpec{name: "refreshToken", path: "/api/refresh", httpOnly: true}
+	// not HttpOnly, the client app reads it to send it back in the
+	// X-CSRF-Token header
+	csrfTokenCookie = cookieSpec{name: "csrfToken", path: "/"}
+	// Lax is needed so the cookie comes back on the top level redirect from
+	// the identity provider
+	oidcStateCookie = cookieSpec{name: "oidcState", path: "/api/oidc", httpOnly: true, sameSite: http.SameSiteLaxMode}
+)
+
+// CookieIssuer sets every cookie of the api the same way, so one place
+// decides how secure they are for the environment.
+type CookieIssuer struct {
+	// Domain is empty for host only cookies
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+	// PrefixNames adds the __Host- prefix to cookies on the root path and
+	// __Secure- to the others, browsers then refuse those cookies unless
+	// they are secure and, for __Host-, not shared with other domains
+	PrefixNames bool
+}
+
+func NewCookieIssuerFromEnv() (*CookieIssuer, error) {
+	ci := &CookieIssuer{
+		Domain:      lib.GetEnv("COOKIE_DOMAIN", ""),
+		Secure:      lib.GetEnvBool("COOKIE_SECURE", true),
+		PrefixNames: lib.GetEnvBool("COOKIE_PREFIX_NAMES", true),
+	}
+	switch sameSite := strings.ToLower(lib.GetEnv("COOKIE_SAMESITE", "lax")); sameSite {
+	case "lax":
+		ci.SameSite = http.SameSiteLaxMode
+	case "strict":
+		ci.SameSite = http.SameSiteStrictMode
+	case "none":
+		ci.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, errors.New("COOKIE_SAMESITE must be lax, strict or none, got " + sameSite)
+	}
+
+	if ci.SameSite == http.SameSiteNoneMode && !ci.Secure {
+		return nil, errors.New("COOKIE_SAMESITE=none needs COOKIE_SECURE=true, browsers reject it otherwise")
+	}
+	if ci.PrefixNames && (!ci.Secure || ci.Domain != "") {
+		return nil, errors.New("COOKIE_PREFIX_NAMES needs COOKIE_SECURE=true and an empty COOKIE_DOMAIN")
+	}
+	return ci, nil
+}
+
+func (ci *CookieIssuer) name(spec cookieSpec) string {
+	switch {
+	case !ci.PrefixNames:
+		return spec.name
+	case spec.path == "/":
+		return "__Host-" + spec.name
+	default:
+		return "__Secure-" + spec.name
+	}
+}
+
+func (ci *CookieIssuer) cookie(spec cookieSpec, value string, maxAge int) *http.Cookie {
+	sameSite := ci.SameSite
+	if spec.sameSite != 0 {
+		sameSite = spec.sameSite
+	}
+	return &http.Cookie{
+		Name:     ci.name(spec),
+		Value:    value,
+		Path:     spec.path,
+		Domain:   ci.Domain,
+		MaxAge:   maxAge,
+		Secure:   ci.Secure,
+		HttpOnly: spec.httpOnly,
+		SameSite: sameSite,
+	}
+}
+
+// set makes the browser keep the cookie for maxAge, it should match the
+// expiry of what the cookie holds.
+func (ci *CookieIssuer) set(c echo.Context, spec cookieSpec, value string, maxAge time.Duration) {
+	seconds := int(maxAge.Seconds())
+	if seconds < 1 {
+		seconds = -1
+	}
+	c.SetCookie(ci.cookie(spec, value, seconds))
+}
+
+func (ci *CookieIssuer) clear(c echo.Context, spec cookieSpec) {
+	c.SetCookie(ci.cookie(spec, "", -1))
+}
+
+// get returns the value of the cookie, or an empty string when the request
+// does not have it.
+func (ci *CookieIssuer) get(c echo.Context, spec cookieSpec) string {
+	cookie, err := c.Cookie(ci.name(spec))
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestNewCookieIssuerFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    *CookieIssuer
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{},
+			want: &CookieIssuer{Secure: true, SameSite: http.SameSiteLaxMode, PrefixNames: true},
+		},
+		{
+			name: "same site none over https",
+			env:  map[string]string{"COOKIE_SAMESITE": "none"},
+			want: &CookieIssuer{Secure: true, SameSite: http.SameSiteNoneMode, PrefixNames: true},
+		},
+		{
+			name: "shared with subdomains",
+			env:  map[string]string{"COOKIE_DOMAIN": "example.com", "COOKIE_PREFIX_NAMES": "false"},
+			want: &CookieIssuer{Domain: "example.com", Secure: true, SameSite: http.SameSiteLaxMode},
+		},
+		{
+			name:    "same site none without secure",
+			env:     map[string]string{"COOKIE_SAMESITE": "none", "COOKIE_SECURE": "false", "COOKIE_PREFIX_NAMES": "false"},
+			wantErr: true,
+		},
+		{
+			name:    "prefixed names with a domain",
+			env:     map[string]string{"COOKIE_DOMAIN": "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "prefixed names without secure",
+			env:     map[string]string{"COOKIE_SECURE": "false"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown same site mode",
+			env:     map[string]string{"COOKIE_SAMESITE": "sometimes"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{"COOKIE_DOMAIN", "COOKIE_SECURE", "COOKIE_SAMESITE", "COOKIE_PREFIX_NAMES"} {
+				t.Setenv(key, test.env[key])
+			}
+
+			cookies, err := NewCookieIssuerFromEnv()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", cookies)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *cookies != *test.want {
+				t.Fatalf("got %+v, want %+v", cookies, test.want)
+			}
+		})
+	}
+}
+
+func TestCookieIssuerSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookies *CookieIssuer
+		spec    cookieSpec
+		maxAge  time.Duration
+		want    http.Cookie
+	}{
+		{
+			name:    "root path gets the host prefix",
+			cookies: &CookieIssuer{Secure: true, SameSite: http.SameSiteStrictMode, PrefixNames: true},
+			spec:    accessTokenCookie,
+			maxAge:  time.Minute,
+			want: http.Cookie{
+				Name: "__Host-accessToken", Path: "/", MaxAge: 60,
+				Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode,
+			},
+		},
+		{
+			name:    "other paths get the secure prefix",
+			cookies: &CookieIssuer{Secure: true, SameSite: http.SameSiteStrictMode, PrefixNames: true},
+			spec:    refreshTokenCookie,
+			maxAge:  time.Hour,
+			want: http.Cookie{
+				Name: "__Secure-refreshToken", Path: "/api/refresh", MaxAge: 3600,
+				Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode,
+			},
+		},
+		{
+			name:    "csrf token is readable by the client app",
+			cookies: &CookieIssuer{Domain: "example.com", SameSite: http.SameSiteLaxMode},
+			spec:    csrfTokenCookie,
+			maxAge:  time.Minute,
+			want: http.Cookie{
+				Name: "csrfToken", Path: "/", Domain: "example.com", MaxAge: 60, SameSite: http.SameSiteLaxMode,
+			},
+		},
+		{
+			name:    "oidc state stays lax under strict",
+			cookies: &CookieIssuer{Secure: true, SameSite: http.SameSiteStrictMode},
+			spec:    oidcStateCookie,
+			maxAge:  OIDC_STATE_TTL,
+			want: http.Cookie{
+				Name: "oidcState", Path: "/api/oidc", MaxAge: 600,
+				Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode,
+			},
+		},
+		{
+			name:    "no max age deletes the cookie",
+			cookies: &CookieIssuer{Secure: true, SameSite: http.SameSiteLaxMode},
+			spec:    accessTokenCookie,
+			want: http.Cookie{
+				Name: "accessToken", Path: "/", MaxAge: -1,
+				Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/signin", nil), rec)
+			test.cookies.set(c, test.spec, "value", test.maxAge)
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want 1", len(cookies))
+			}
+			got, want := *cookies[0], test.want
+			if got.Name != want.Name || got.Path != want.Path || got.Domain != want.Domain ||
+				got.MaxAge != want.MaxAge || got.Secure != want.Secure || got.HttpOnly != want.HttpOnly ||
+				got.SameSite != want.SameSite {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
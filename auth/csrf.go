@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// the csrf token is a double submit token: sign in stores it in a cookie the
+// client app can read, and the app sends it back in a header on every
+// request that changes something. Other sites can make the browser send the
+// cookie but they cannot read it to set the header.
+const CSRF_HEADER_NAME = "X-CSRF-Token"
+
+var csrfFailedResponse = web.Response{
+	Status: web.STATUS_FAIL,
+	Code:   http.StatusForbidden,
+	Error: web.Error{
+		Message: "missing or invalid csrf token, send the value of the csrfToken cookie in the " + CSRF_HEADER_NAME + " header",
+	},
+}
+
+// CSRFProtection checks the csrf token of unsafe requests that are
+// authenticated with cookies, bearer tokens are never sent by the browser on
+// its own so they do not need it.
+func (am *AuthMiddleware) CSRFProtection(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			return next(c)
+		}
+		if bearerToken(c) != "" {
+			return next(c)
+		}
+		if am.config.Cookies.get(c, accessTokenCookie) == "" {
+			return next(c)
+		}
+
+		csrfToken := am.config.Cookies.get(c, csrfTokenCookie)
+		csrfHeader := c.Request().Header.Get(CSRF_HEADER_NAME)
+		if csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfToken), []byte(csrfHeader)) != 1 {
+			return c.JSON(http.StatusForbidden, csrfFailedResponse)
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		accessToken string
+		bearer      string
+		csrfCookie  string
+		csrfHeader  string
+		wantCode    int
+	}{
+		{
+			name:        "matching cookie and header",
+			method:      http.MethodPost,
+			accessToken: "access token",
+			csrfCookie:  "csrf token",
+			csrfHeader:  "csrf token",
+			wantCode:    http.StatusNoContent,
+		},
+		{
+			name:        "missing header",
+			method:      http.MethodPost,
+			accessToken: "access token",
+			csrfCookie:  "csrf token",
+			wantCode:    http.StatusForbidden,
+		},
+		{
+			name:        "header does not match the cookie",
+			method:      http.MethodDelete,
+			accessToken: "access token",
+			csrfCookie:  "csrf token",
+			csrfHeader:  "another csrf token",
+			wantCode:    http.StatusForbidden,
+		},
+		{
+			name:        "missing cookie",
+			method:      http.MethodPut,
+			accessToken: "access token",
+			csrfHeader:  "csrf token",
+			wantCode:    http.StatusForbidden,
+		},
+		{
+			name:        "bearer token is not checked",
+			method:      http.MethodPost,
+			accessToken: "access token",
+			bearer:      "access token",
+			wantCode:    http.StatusNoContent,
+		},
+		{
+			name:        "safe method is not checked",
+			method:      http.MethodGet,
+			accessToken: "access token",
+			wantCode:    http.StatusNoContent,
+		},
+		{
+			name:     "request without the access token cookie is not checked",
+			method:   http.MethodPost,
+			wantCode: http.StatusNoContent,
+		},
+	}
+
+	for _, cookies := range []*CookieIssuer{{Secure: true}, {Secure: true, PrefixNames: true}} {
+		authMiddleware := NewAuthMiddleware(nil, nil, Config{Cookies: cookies})
+		handler := authMiddleware.CSRFProtection(func(c echo.Context) error {
+			return c.NoContent(http.StatusNoContent)
+		})
+
+		for _, test := range tests {
+			t.Run(cookies.name(accessTokenCookie)+"/"+test.name, func(t *testing.T) {
+				req := httptest.NewRequest(test.method, "/api/auth/articles", nil)
+				if test.accessToken != "" {
+					req.AddCookie(&http.Cookie{Name: cookies.name(accessTokenCookie), Value: test.accessToken})
+				}
+				if test.csrfCookie != "" {
+					req.AddCookie(&http.Cookie{Name: cookies.name(csrfTokenCookie), Value: test.csrfCookie})
+				}
+				if test.csrfHeader != "" {
+					req.Header.Set(CSRF_HEADER_NAME, test.csrfHeader)
+				}
+				if test.bearer != "" {
+					req.Header.Set(echo.HeaderAuthorization, "Bearer "+test.bearer)
+				}
+				rec := httptest.NewRecorder()
+				if err := handler(echo.New().NewContext(req, rec)); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Code != test.wantCode {
+					t.Fatalf("got status %d, want %d", rec.Code, test.wantCode)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+func (asi *AuthServiceImpl) VerifyEmail(data *EmailVerificationRequest, ctx context.Context) *web.Response {
+	err := asi.v.Struct(data)
+	if err != nil {
+		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "validation error",
+				Detail:  validatedError,
+			},
+		}
+	}
+
+	token, err := asi.AuthRepository.UseUserToken(hashSecretToken(data.Token), USER_TOKEN_EMAIL_VERIFICATION, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	err = asi.AuthRepository.MarkEmailVerified(token.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+	}
+}
+
+// ResendEmailVerification mails a new link, it shares a per user throttle
+// with ChangeEmail so neither can be used to flood a mailbox.
+func (asi *AuthServiceImpl) ResendEmailVerification(accessToken *AccessToken, ctx context.Context) *web.Response {
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	if user.Email == "" {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: "your account has no email address, please add one first",
+			},
+		}
+	}
+	if user.EmailVerified {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: "there is no email address waiting for verification",
+			},
+		}
+	}
+
+	if errorResponse := asi.throttleEmailVerification(user); errorResponse != nil {
+		return errorResponse
+	}
+	asi.sendEmailVerification(user, ctx)
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusAccepted,
+	}
+}
+
+// ChangeEmail sets a new email address and sends it a verification link, it
+// is also how accounts created before emails were collected get one. A
+// stolen session could otherwise take the account over through a password
+// reset, so the current password is asked for when the account has one.
+func (asi *AuthServiceImpl) ChangeEmail(
+	accessToken *AccessToken, data *ChangeEmailRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_EMAIL_CHANGE, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	if user.Password != "" {
+		key := "change_email:" + strconv.FormatInt(user.Id, 10)
+		errorResponse := asi.throttleAttempts(key, func() error {
+			if !asi.config.PasswordHasher.Verify(user.Password, data.CurrentPassword) {
+				return errors.New("current password is incorrect")
+			}
+			return nil
+		})
+		if errorResponse != nil {
+			return errorResponse
+		}
+	}
+	if strings.EqualFold(user.Email, data.Email) && user.EmailVerified {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: "this is already your email address",
+			},
+		}
+	}
+
+	if errorResponse := asi.throttleEmailVerification(user); errorResponse != nil {
+		return errorResponse
+	}
+
+	err = asi.AuthRepository.UpdateUserEmail(user.Id, data.Email, ctx)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrEmailTaken) {
+			code = http.StatusConflict
+		}
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   code,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	previousEmail := user.Email
+	user.Email = data.Email
+	user.EmailVerified = false
+	asi.sendEmailVerification(user, ctx)
+	if previousEmail != "" && !strings.EqualFold(previousEmail, data.Email) {
+		go asi.sendMail("change_email_service", lib.Mail{
+			To:      previousEmail,
+			Subject: "Your email address was changed",
+			Body: "Hi " + user.Username + ",\r\n\r\n" +
+				"The email address of your account was changed to " + data.Email + ". " +
+				"If you did not do this, please reset your password and contact us.",
+		})
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   user,
+	}
+}
+
+func (asi *AuthServiceImpl) throttleEmailVerification(user *User) *web.Response {
+	return asi.throttleRequests("too many verification emails requested, please try again later", map[string]int{
+		"email_verification:" + strconv.FormatInt(user.Id, 10): asi.config.EmailVerificationMaxRequests,
+	})
+}
+
+func (asi *AuthServiceImpl) sendEmailVerification(user *User, ctx context.Context) {
+	token, tokenHash := newSecretToken()
+	err := asi.AuthRepository.CreateUserToken(&UserToken{
+		UserId:    user.Id,
+		Purpose:   USER_TOKEN_EMAIL_VERIFICATION,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(asi.config.EmailVerificationTokenTTL),
+	}, ctx)
+	if err != nil {
+		// the user can ask for another link later, signing up must not fail
+		// because of it
+		return
+	}
+
+	link := asi.config.EmailVerificationURL + "?token=" + url.QueryEscape(token)
+	go asi.sendMail("send_email_verification_service", lib.Mail{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: "Hi " + user.Username + ",\r\n\r\n" +
+			"Please confirm your email address by opening the link below, " +
+			"it expires in " + asi.config.EmailVerificationTokenTTL.String() + ".\r\n\r\n" + link,
+	})
+}
@@ -1,16 +1,45 @@
 package auth
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
 type User struct {
-	Id        int64     `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"createdAt"`
+	Id            int64  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Password      string `json:"-"`
+	Role          string `json:"role"`
+	TotpSecret    string `json:"-"`
+	TotpEnabled   bool   `json:"totpEnabled"`
+	DisplayName   string `json:"displayName"`
+	Bio           string `json:"bio"`
+	Website       string `json:"website"`
+	Avatar        string `json:"avatar"`
+	// DeletionScheduledAt is set while the user waits for their account to
+	// be deleted
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt"`
+	// SuspendedAt is set while an admin keeps the user from signing in
+	SuspendedAt      *time.Time `json:"suspendedAt"`
+	SuspensionReason string     `json:"suspensionReason,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+}
+
+// UpdateProfileRequest only changes the fields that are sent, send an empty
+// string to clear one.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"displayName" validate:"omitempty,max=100"`
+	Bio         *string `json:"bio" validate:"omitempty,max=500"`
+	Website     *string `json:"website" validate:"omitempty,len=0|http_url,max=255"`
+	// Avatar is a file name returned by the file upload endpoint
+	Avatar *string `json:"avatar" validate:"omitempty,max=255"`
 }
 
 type UserSignUpRequest struct {
 	Username             string `json:"username" validate:"required"`
+	Email                string `json:"email" validate:"required,email"`
 	Password             string `json:"password" validate:"required"`
 	PasswordConfirmation string `json:"passwordConfirmation" validate:"eqfield=Password"`
 }
@@ -20,7 +49,302 @@ type UserSignInRequest struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// ClientInfo describes where a request came from, handlers put it in the
+// request context under the "clientInfo" key.
+type ClientInfo struct {
+	IpAddress string
+	UserAgent string
+}
+
+type RetryAfterDetail struct {
+	RetryAfter int `json:"retryAfter"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// TokenResponse is returned instead of cookies to clients that opt in with
+// the X-Token-Delivery: body header, eg: mobile apps and cli scripts.
+type TokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
 type UserAuthResponse struct {
 	UserId   int64  `json:"user_id"`
 	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+}
+
+type UpdateUserRoleRequest struct {
+	UserId int64  `param:"id" validate:"required"`
+	Role   string `json:"role" validate:"required,oneof=reader author editor admin"`
+}
+
+// Session is a signed in device, its id is the family id of the refresh
+// tokens issued to it.
+type Session struct {
+	Id         string    `json:"id"`
+	UserId     int64     `json:"-"`
+	UserAgent  string    `json:"userAgent"`
+	IpAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+type SessionRequest struct {
+	Id string `param:"id" validate:"required"`
+}
+
+type StoredRefreshToken struct {
+	Id        string
+	FamilyId  string
+	UserId    int64
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+	RevokedAt sql.NullTime
+}
+
+const (
+	USER_TOKEN_PASSWORD_RESET     = "password_reset"
+	USER_TOKEN_EMAIL_VERIFICATION = "email_verification"
+	USER_TOKEN_MAGIC_LINK         = "magic_link"
+	// the id of a two factor challenge, the challenge itself is a jwt
+	USER_TOKEN_TWO_FACTOR_CHALLENGE = "two_factor_challenge"
+)
+
+type UserToken struct {
+	Id        int64
+	UserId    int64
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type PasswordResetRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+// ChangeEmailRequest sets the address account mails go to, accounts with a
+// password have to confirm it.
+type ChangeEmailRequest struct {
+	Email           string `json:"email" validate:"required,email,max=255"`
+	CurrentPassword string `json:"currentPassword"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword      string `json:"currentPassword" validate:"required"`
+	Password             string `json:"password" validate:"required"`
+	PasswordConfirmation string `json:"passwordConfirmation" validate:"eqfield=Password"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token                string `json:"token" validate:"required"`
+	Password             string `json:"password" validate:"required"`
+	PasswordConfirmation string `json:"passwordConfirmation" validate:"eqfield=Password"`
+}
+
+type ImpersonateUserRequest struct {
+	Id int64 `param:"id" validate:"required"`
+	// Reason is kept in the audit log, eg the ticket being reproduced
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+type ImpersonationResponse struct {
+	AccessToken string `json:"accessToken"`
+	TokenType   string `json:"tokenType"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+// IntrospectionRequest is form encoded as RFC 7662 asks, the client
+// credentials can also be sent with basic auth.
+type IntrospectionRequest struct {
+	Token         string `form:"token" validate:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+	ClientId      string `form:"client_id"`
+	ClientSecret  string `form:"client_secret"`
+}
+
+// IntrospectionResponse only has active set for inactive tokens, active
+// ones carry their claims.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+	// Scope is the space separated scopes of a personal access token
+	Scope string `json:"scope,omitempty"`
+	*AccessToken
+}
+
+// MagicLinkRequest takes either the username or the email address of the
+// account.
+type MagicLinkRequest struct {
+	Login string `json:"login" validate:"required"`
+}
+
+type MagicLinkSignInRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type EmailVerificationRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type TotpCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TotpEnrollmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// TwoFactorChallengeResponse is what SignIn answers with instead of tokens
+// when the account has two factor authentication enabled.
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+}
+
+// TwoFactorSignInRequest finishes a sign in, either Code or RecoveryCode
+// must be set.
+type TwoFactorSignInRequest struct {
+	ChallengeToken string `json:"challengeToken" validate:"required"`
+	Code           string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// PersonalAccessToken lets scripts call the api without signing in, it can
+// only do what its scopes and the role of its owner both allow.
+type PersonalAccessToken struct {
+	Id         int64      `json:"id"`
+	UserId     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// CreatePersonalAccessTokenRequest leaves users:manage out of the scopes on
+// purpose, managing users needs a session.
+type CreatePersonalAccessTokenRequest struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=articles:write articles:moderate files:write"`
+	// ExpiresInDays defaults to PERSONAL_ACCESS_TOKEN_DEFAULT_TTL_DAYS
+	ExpiresInDays int `json:"expiresInDays" validate:"omitempty,min=1,max=365"`
+}
+
+// CreatedPersonalAccessTokenResponse is the only time the token itself is
+// shown, it cannot be recovered afterwards.
+type CreatedPersonalAccessTokenResponse struct {
+	PersonalAccessToken
+	Token string `json:"token"`
+}
+
+type PersonalAccessTokenRequest struct {
+	Id int64 `param:"id" validate:"required"`
+}
+
+const (
+	DELETION_ARTICLES_DELETE   = "delete"
+	DELETION_ARTICLES_REASSIGN = "reassign"
+)
+
+// DeleteAccountRequest schedules the deletion of the account of the signed
+// in user. Password is only required from users that have one.
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	// Articles is what happens to the articles of the user, they are either
+	// deleted or handed to the "[deleted]" placeholder author
+	Articles string `json:"articles" validate:"required,oneof=delete reassign"`
+}
+
+type ScheduledDeletion struct {
+	UserId      int64
+	Articles    string
+	ScheduledAt time.Time
+}
+
+const (
+	USER_STATUS_ACTIVE    = "active"
+	USER_STATUS_SUSPENDED = "suspended"
+)
+
+// UserListRequest filters the users admins see, Query matches the
+// username, email and display name.
+type UserListRequest struct {
+	Query   string `query:"q" validate:"max=100"`
+	Role    string `query:"role" validate:"omitempty,oneof=reader author editor admin"`
+	Status  string `query:"status" validate:"omitempty,oneof=active suspended"`
+	Page    int    `query:"page" validate:"omitempty,min=1"`
+	PerPage int    `query:"perPage" validate:"omitempty,min=1,max=100"`
+}
+
+type UserListResponse struct {
+	Users   []User `json:"users"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"perPage"`
+	Total   int    `json:"total"`
+}
+
+type UserRequest struct {
+	Id int64 `param:"id" validate:"required"`
+}
+
+type SuspendUserRequest struct {
+	Id     int64  `param:"id" validate:"required"`
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type AuditEvent struct {
+	Id        int64     `json:"id"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	UserId    int64     `json:"userId,omitempty"`
+	ActorId   int64     `json:"actorId,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	IpAddress string    `json:"ipAddress"`
+	UserAgent string    `json:"userAgent"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuditEventListRequest filters the audit log, From and To are RFC 3339
+// timestamps. Page and PerPage are ignored by the export.
+type AuditEventListRequest struct {
+	Event   string `query:"event" validate:"max=64"`
+	UserId  int64  `query:"userId"`
+	Outcome string `query:"outcome" validate:"omitempty,oneof=success failure"`
+	From    string `query:"from" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	To      string `query:"to" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	Page    int    `query:"page" validate:"omitempty,min=1"`
+	PerPage int    `query:"perPage" validate:"omitempty,min=1,max=100"`
+}
+
+type AuditEventFilter struct {
+	Event   string
+	UserId  int64
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Page    int
+	PerPage int
+}
+
+type AuditEventListResponse struct {
+	Events  []AuditEvent `json:"events"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"perPage"`
+	Total   int          `json:"total"`
 }
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const IMPERSONATED_BY_HEADER_NAME = "X-Impersonated-By"
+
+// ImpersonateUser gives an admin a short lived access token of another user
+// to reproduce what they see, the admin is kept in the act claim. There is
+// no refresh token and the token belongs to the session of the admin, so
+// signing out ends the impersonation too.
+func (asi *AuthServiceImpl) ImpersonateUser(
+	accessToken *AccessToken, data *ImpersonateUserRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_IMPERSONATION, UserId: data.Id, ActorId: accessToken.UserId, Detail: data.Reason}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	if data.Id == accessToken.UserId || accessToken.Actor != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "you cannot impersonate yourself or impersonate while impersonating",
+			},
+		}
+	}
+
+	user, err := asi.AuthRepository.FindUserById(data.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	event.Username = user.Username
+	// acting as another admin would hide who really did what
+	if user.Role == ROLE_ADMIN || user.SuspendedAt != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusForbidden,
+			Error: web.Error{
+				Message: "admins and suspended users cannot be impersonated",
+			},
+		}
+	}
+
+	claims := &AccessToken{
+		AccessTokenId: newTokenId(),
+		SessionId:     accessToken.SessionId,
+		UserId:        user.Id,
+		Username:      user.Username,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
+		Actor: &Actor{
+			UserId:   accessToken.UserId,
+			Username: accessToken.Username,
+		},
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(asi.config.ImpersonationTokenTTL)),
+		},
+	}
+	token, err := asi.keyRing.Sign(claims, JWT_TYPE_ACCESS_TOKEN)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: "failed to create token, please try again",
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusCreated,
+		Data: ImpersonationResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   int64(asi.config.ImpersonationTokenTTL.Seconds()),
+		},
+	}
+}
+
+// impersonatedBy is the value of the X-Impersonated-By header sent with
+// every response to an impersonation token.
+func impersonatedBy(actor *Actor) string {
+	return actor.Username + " (" + strconv.FormatInt(actor.UserId, 10) + ")"
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const (
+	TOKEN_TYPE_ACCESS_TOKEN          = "access_token"
+	TOKEN_TYPE_PERSONAL_ACCESS_TOKEN = "personal_access_token"
+)
+
+// NewIntrospectionClientsFromEnv reads the services allowed to introspect
+// tokens from INTROSPECTION_CLIENTS, then INTROSPECTION_<NAME>_CLIENT_SECRET
+// for each of them. The name is the client id, only the sha256 of the
+// secret is kept.
+func NewIntrospectionClientsFromEnv() (map[string]string, error) {
+	clients := map[string]string{}
+	for _, name := range strings.Split(os.Getenv("INTROSPECTION_CLIENTS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		key := "INTROSPECTION_" + strings.ToUpper(name) + "_CLIENT_SECRET"
+		secret := os.Getenv(key)
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("%v must be at least 32 characters long", key)
+		}
+		clients[name] = hashSecretToken(secret)
+	}
+	return clients, nil
+}
+
+// IntrospectToken tells an internal service whether a token is active, as
+// described by RFC 7662. Tokens that are expired, revoked, malformed or
+// belong to a suspended or deleted user are all just inactive, the reason is
+// not given away.
+func (asi *AuthServiceImpl) IntrospectToken(data *IntrospectionRequest, ctx context.Context) (*IntrospectionResponse, *web.Response) {
+	if !asi.isIntrospectionClient(data.ClientId, data.ClientSecret) {
+		return nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusUnauthorized,
+			Error: web.Error{
+				Message: "client authentication failed",
+			},
+		}
+	}
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return nil, errorResponse
+	}
+
+	accessToken, err := activeAccessToken(asi.AuthRepository, asi.keyRing, data.Token, ctx)
+	if err != nil {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	response := &IntrospectionResponse{
+		Active:      true,
+		TokenType:   TOKEN_TYPE_ACCESS_TOKEN,
+		AccessToken: accessToken,
+	}
+	if accessToken.PersonalAccessTokenId != 0 {
+		response.TokenType = TOKEN_TYPE_PERSONAL_ACCESS_TOKEN
+		response.Scope = strings.Join(accessToken.Scopes, " ")
+	}
+	return response, nil
+}
+
+func (asi *AuthServiceImpl) isIntrospectionClient(clientId, clientSecret string) bool {
+	secretHash, ok := asi.config.IntrospectionClients[clientId]
+	if !ok || clientSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secretHash), []byte(hashSecretToken(clientSecret))) == 1
+}
+
+// activeAccessToken returns the claims of rawToken, a jwt access token or a
+// personal access token, as long as it is still active. Personal access
+// tokens are looked up with their owner every time so a changed role
+// applies straight away.
+func activeAccessToken(repository AuthRepository, keyRing *KeyRing, rawToken string, ctx context.Context) (*AccessToken, error) {
+	if strings.HasPrefix(rawToken, PERSONAL_ACCESS_TOKEN_PREFIX) {
+		tokenHash := hashSecretToken(strings.TrimPrefix(rawToken, PERSONAL_ACCESS_TOKEN_PREFIX))
+		personalAccessToken, err := repository.FindPersonalAccessTokenByHash(tokenHash, ctx)
+		if err != nil {
+			return nil, err
+		}
+		user, err := repository.FindUserById(personalAccessToken.UserId, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if user.SuspendedAt != nil {
+			return nil, errors.New("user is suspended")
+		}
+		repository.TouchPersonalAccessToken(personalAccessToken.Id, ctx)
+
+		return &AccessToken{
+			UserId:                user.Id,
+			Username:              user.Username,
+			Role:                  user.Role,
+			EmailVerified:         user.EmailVerified,
+			PersonalAccessTokenId: personalAccessToken.Id,
+			Scopes:                personalAccessToken.Scopes,
+			RegisteredClaims: jwt.RegisteredClaims{
+				IssuedAt:  jwt.NewNumericDate(personalAccessToken.CreatedAt),
+				ExpiresAt: jwt.NewNumericDate(personalAccessToken.ExpiresAt),
+			},
+		}, nil
+	}
+
+	accessToken := &AccessToken{}
+	err := keyRing.Parse(rawToken, accessToken, JWT_TYPE_ACCESS_TOKEN)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken.AccessTokenId == "" {
+		return nil, errors.New("not an access token")
+	}
+	revoked, err := repository.IsAccessTokenRevoked(accessToken, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("access token is revoked")
+	}
+	// the admin behind an impersonation must still be one
+	if accessToken.Actor != nil {
+		actor, err := repository.FindUserById(accessToken.Actor.UserId, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if actor.Role != ROLE_ADMIN || actor.SuspendedAt != nil {
+			return nil, errors.New("impersonating user is not an admin anymore")
+		}
+	}
+	return accessToken, nil
+}
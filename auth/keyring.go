@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type SigningKey struct {
+	Id        string
+	Method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+	// ExpiresAt is only set on retired keys, after it passes tokens signed
+	// with the key are no longer accepted
+	ExpiresAt time.Time
+}
+
+// KeyRing signs new tokens with the current key and validates tokens signed
+// by any key it holds, which lets us rotate keys without signing everybody out.
+type KeyRing struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func NewHMACKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{
+		Id:        id,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}
+}
+
+func NewRSAKey(id string, privateKey *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{
+		Id:        id,
+		Method:    jwt.SigningMethodRS256,
+		signKey:   privateKey,
+		verifyKey: &privateKey.PublicKey,
+	}
+}
+
+func NewEd25519Key(id string, privateKey ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{
+		Id:        id,
+		Method:    jwt.SigningMethodEdDSA,
+		signKey:   privateKey,
+		verifyKey: privateKey.Public(),
+	}
+}
+
+func NewKeyRing(current *SigningKey, previous ...*SigningKey) *KeyRing {
+	keyRing := &KeyRing{
+		current: current,
+		keys:    map[string]*SigningKey{current.Id: current},
+	}
+	for _, key := range previous {
+		keyRing.keys[key.Id] = key
+	}
+	return keyRing
+}
+
+// NewKeyRingFromEnv builds the key ring from JWT_SIGNING_KEY_ID and
+// JWT_SIGNING_ALGORITHM (HS256, RS256 or EdDSA). HS256 reads the secret from
+// JWT_SIGNING_KEY, the asymmetric algorithms read a PEM encoded private key
+// from the path in JWT_SIGNING_KEY_FILE. During a rotation the old key goes
+// into the same variables prefixed with JWT_PREVIOUS_ instead of JWT_, and
+// JWT_PREVIOUS_SIGNING_KEY_EXPIRES_AT (RFC 3339) ends the rotation window.
+func NewKeyRingFromEnv() (*KeyRing, error) {
+	current, err := signingKeyFromEnv("JWT_SIGNING_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, errors.New("JWT_SIGNING_KEY_ID and JWT_SIGNING_KEY are required")
+	}
+
+	previous, err := signingKeyFromEnv("JWT_PREVIOUS_SIGNING_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return NewKeyRing(current), nil
+	}
+	if previous.Id == current.Id {
+		return nil, errors.New("JWT_PREVIOUS_SIGNING_KEY_ID must differ from JWT_SIGNING_KEY_ID")
+	}
+	if expiresAt := os.Getenv("JWT_PREVIOUS_SIGNING_KEY_EXPIRES_AT"); expiresAt != "" {
+		previous.ExpiresAt, err = time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PREVIOUS_SIGNING_KEY_EXPIRES_AT: %w", err)
+		}
+	}
+	return NewKeyRing(current, previous), nil
+}
+
+func signingKeyFromEnv(prefix string) (*SigningKey, error) {
+	id := os.Getenv(prefix + "_ID")
+	algorithm := os.Getenv(strings.TrimSuffix(prefix, "_KEY") + "_ALGORITHM")
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodHS256.Alg()
+	}
+
+	if algorithm == jwt.SigningMethodHS256.Alg() {
+		secret := os.Getenv(prefix)
+		if id == "" && secret == "" {
+			return nil, nil
+		}
+		if id == "" || secret == "" {
+			return nil, fmt.Errorf("both %v_ID and %v must be set", prefix, prefix)
+		}
+		return NewHMACKey(id, []byte(secret)), nil
+	}
+
+	keyFile := os.Getenv(prefix + "_FILE")
+	if id == "" && keyFile == "" {
+		return nil, nil
+	}
+	if id == "" || keyFile == "" {
+		return nil, fmt.Errorf("both %v_ID and %v_FILE must be set", prefix, prefix)
+	}
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v_FILE: %w", prefix, err)
+	}
+
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%v_FILE: %w", prefix, err)
+		}
+		return NewRSAKey(id, privateKey), nil
+	case jwt.SigningMethodEdDSA.Alg():
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%v_FILE: %w", prefix, err)
+		}
+		edPrivateKey, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%v_FILE is not an Ed25519 key", prefix)
+		}
+		return NewEd25519Key(id, edPrivateKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %v", algorithm)
+	}
+}
+
+// every kind of token is signed with the same keys, which are published,
+// the typ header tells them apart. Access tokens use the type of RFC 9068 so
+// other services can verify them with the published keys.
+const (
+	JWT_TYPE_ACCESS_TOKEN         = "at+jwt"
+	JWT_TYPE_REFRESH_TOKEN        = "refresh+jwt"
+	JWT_TYPE_TWO_FACTOR_CHALLENGE = "2fa-challenge+jwt"
+	JWT_TYPE_OIDC_STATE           = "oidc-state+jwt"
+)
+
+// Sign signs claims as a token of tokenType, one of the JWT_TYPE_ constants.
+func (kr *KeyRing) Sign(claims jwt.Claims, tokenType string) (string, error) {
+	token := jwt.NewWithClaims(kr.current.Method, claims)
+	token.Header["kid"] = kr.current.Id
+	token.Header["typ"] = tokenType
+	return token.SignedString(kr.current.signKey)
+}
+
+// Parse verifies rawToken into claims, it fails unless the token was signed
+// by Sign as a token of tokenType.
+func (kr *KeyRing) Parse(rawToken string, claims jwt.Claims, tokenType string) error {
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != tokenType {
+			return nil, errors.New("unexpected token type")
+		}
+		return kr.Keyfunc(t)
+	})
+	return err
+}
+
+// Keyfunc is meant to be passed to jwt.ParseWithClaims.
+func (kr *KeyRing) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	// never let the token pick its own algorithm, otherwise a token could
+	// claim to be signed with a weaker or different kind of key
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return nil, errors.New("signing key expired")
+	}
+	return key.verifyKey, nil
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// PublicKeys returns the verification keys other services need to validate
+// our tokens. HMAC secrets are never published.
+func (kr *KeyRing) PublicKeys() JSONWebKeySet {
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range kr.keys {
+		if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+			continue
+		}
+
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keySet.Keys = append(keySet.Keys, JSONWebKey{
+				Kty: "RSA",
+				Kid: key.Id,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keySet.Keys = append(keySet.Keys, JSONWebKey{
+				Kty: "OKP",
+				Kid: key.Id,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+	return keySet
+}
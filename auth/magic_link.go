@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// RequestMagicLink mails a single use sign in link to the account, it
+// answers the same way whether the account exists or not, like
+// RequestPasswordReset. Every request counts against the login and the ip
+// address, so the endpoint cannot be used to flood a mailbox.
+func (asi *AuthServiceImpl) RequestMagicLink(data *MagicLinkRequest, ctx context.Context) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	// counted before the account is looked up, an unknown login is throttled
+	// the same as a known one
+	errorResponse := asi.throttleRequests("too many sign in links requested, please try again later", map[string]int{
+		"magic:" + strings.ToLower(data.Login):       asi.config.MagicLinkMaxRequests,
+		"ip:" + clientInfoFromContext(ctx).IpAddress: asi.config.LoginMaxAttemptsPerIp,
+	})
+	if errorResponse != nil {
+		return errorResponse
+	}
+
+	response := &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusAccepted,
+		Data: map[string]string{
+			"message": "if the account exists, a sign in link has been sent to its email address",
+		},
+	}
+
+	user, err := asi.AuthRepository.FindUserByLogin(data.Login, ctx)
+	if err != nil || user.Email == "" || user.SuspendedAt != nil {
+		return response
+	}
+
+	// like RequestPasswordReset, nothing is written while the request waits
+	go asi.sendMagicLink(user)
+
+	return response
+}
+
+func (asi *AuthServiceImpl) sendMagicLink(user *User) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	token, tokenHash := newSecretToken()
+	err := asi.AuthRepository.CreateUserToken(&UserToken{
+		UserId:    user.Id,
+		Purpose:   USER_TOKEN_MAGIC_LINK,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(asi.config.MagicLinkTokenTTL),
+	}, ctx)
+	if err != nil {
+		return
+	}
+
+	link := asi.config.MagicLinkURL + "?token=" + url.QueryEscape(token)
+	asi.sendMail("request_magic_link_service", lib.Mail{
+		To:      user.Email,
+		Subject: "Your sign in link",
+		Body: "Hi " + user.Username + ",\r\n\r\n" +
+			"Open the link below to sign in, it can only be used once and expires in " +
+			asi.config.MagicLinkTokenTTL.String() + ".\r\n\r\n" + link + "\r\n\r\n" +
+			"If you did not ask for it, you can ignore this email.",
+	})
+}
+
+// SignInWithMagicLink exchanges the token of a magic link for the same
+// tokens SignIn returns. The link only stands in for the password, accounts
+// with two factor enabled still get a challenge.
+func (asi *AuthServiceImpl) SignInWithMagicLink(
+	data *MagicLinkSignInRequest, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_IN_MAGIC_LINK}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return nil, nil, errorResponse
+	}
+
+	token, err := asi.AuthRepository.UseUserToken(hashSecretToken(data.Token), USER_TOKEN_MAGIC_LINK, ctx)
+	if err != nil {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	event.UserId = token.UserId
+
+	user, err := asi.AuthRepository.FindUserById(token.UserId, ctx)
+	if err != nil {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "link is invalid or has expired",
+			},
+		}
+	}
+	event.Username = user.Username
+
+	// the link was read from the mailbox, which is all verifying the email
+	// address would prove
+	if !user.EmailVerified && asi.AuthRepository.MarkEmailVerified(user.Id, ctx) == nil {
+		user.EmailVerified = true
+	}
+
+	if user.TotpEnabled {
+		event.Detail = "two factor required"
+		return nil, nil, asi.newTwoFactorChallenge(user, ctx)
+	}
+	return asi.issueTokens(user, "", ctx)
+}
@@ -1,22 +1,61 @@
 package auth
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"slices"
+	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/zulfikarrosadi/go-blog-api/web"
 )
 
 type Auth interface {
 	AuthenticationRequired(next echo.HandlerFunc) echo.HandlerFunc
 	DeserializeUser(next echo.HandlerFunc) echo.HandlerFunc
+	RequireRole(roles ...string) echo.MiddlewareFunc
+	RequirePermission(permission string) echo.MiddlewareFunc
+	RequireVerifiedEmail(next echo.HandlerFunc) echo.HandlerFunc
+	RequireSession(next echo.HandlerFunc) echo.HandlerFunc
+	CSRFProtection(next echo.HandlerFunc) echo.HandlerFunc
 }
 
-type AuthMiddleware struct{}
+var forbiddenResponse = web.Response{
+	Status: web.STATUS_FAIL,
+	Code:   http.StatusForbidden,
+	Error: web.Error{
+		Message: "you do not have permission to perform this action",
+	},
+}
+
+var impersonationNotAllowedResponse = web.Response{
+	Status: web.STATUS_FAIL,
+	Code:   http.StatusForbidden,
+	Error: web.Error{
+		Message: "this action is not allowed while impersonating a user",
+	},
+}
+
+var personalAccessTokenNotAllowedResponse = web.Response{
+	Status: web.STATUS_FAIL,
+	Code:   http.StatusForbidden,
+	Error: web.Error{
+		Message: "personal access tokens cannot be used for this action, please sign in",
+	},
+}
+
+type AuthMiddleware struct {
+	AuthRepository
+	keyRing *KeyRing
+	config  Config
+}
 
-func NewAuthMiddleware() AuthMiddleware {
-	return AuthMiddleware{}
+func NewAuthMiddleware(authRepository AuthRepository, keyRing *KeyRing, config Config) AuthMiddleware {
+	return AuthMiddleware{
+		AuthRepository: authRepository,
+		keyRing:        keyRing,
+		config:         config,
+	}
 }
 
 func (am *AuthMiddleware) AuthenticationRequired(next echo.HandlerFunc) echo.HandlerFunc {
@@ -30,31 +69,145 @@ func (am *AuthMiddleware) AuthenticationRequired(next echo.HandlerFunc) echo.Han
 	}
 }
 
-func (am *AuthMiddleware) DeserializeUser(next echo.HandlerFunc) echo.HandlerFunc {
+// RequireRole must run after AuthenticationRequired. The role claim lasts as
+// long as the access token, so it is checked against the user as well, a
+// demoted admin loses access straight away.
+func (am *AuthMiddleware) RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			accessToken, ok := c.Get("accessToken").(AccessToken)
+			if !ok {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			if accessToken.PersonalAccessTokenId != 0 {
+				return c.JSON(http.StatusForbidden, personalAccessTokenNotAllowedResponse)
+			}
+			if !slices.Contains(roles, accessToken.Role) {
+				return c.JSON(http.StatusForbidden, forbiddenResponse)
+			}
+			role, ok := am.currentRole(accessToken, c.Request().Context())
+			if !ok || !slices.Contains(roles, role) {
+				return c.JSON(http.StatusForbidden, forbiddenResponse)
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequirePermission must run after AuthenticationRequired. Like RequireRole
+// it checks the role of the user again, but only for permissions a new
+// account does not get, which keeps a query off every article write.
+func (am *AuthMiddleware) RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			accessToken, ok := c.Get("accessToken").(AccessToken)
+			if !ok {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			if !accessToken.HasPermission(permission) {
+				return c.JSON(http.StatusForbidden, forbiddenResponse)
+			}
+			if !HasPermission(ROLE_AUTHOR, permission) {
+				role, ok := am.currentRole(accessToken, c.Request().Context())
+				if !ok || !HasPermission(role, permission) {
+					return c.JSON(http.StatusForbidden, forbiddenResponse)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// currentRole looks up the role the user of accessToken has now, ok is false
+// when the user is gone or suspended.
+func (am *AuthMiddleware) currentRole(accessToken AccessToken, ctx context.Context) (role string, ok bool) {
+	user, err := am.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil || user.SuspendedAt != nil {
+		return "", false
+	}
+	return user.Role, true
+}
+
+// RequireVerifiedEmail only does something when REQUIRE_VERIFIED_EMAIL is
+// enabled, it must run after AuthenticationRequired.
+func (am *AuthMiddleware) RequireVerifiedEmail(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		fmt.Println("deserialize")
-		accessTokenCookie, err := c.Cookie("accessToken")
-		if err != nil {
-			fmt.Println(err)
+		if !am.config.RequireVerifiedEmail {
+			return next(c)
+		}
+		accessToken, ok := c.Get("accessToken").(AccessToken)
+		if !ok {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		if accessToken.EmailVerified {
 			return next(c)
 		}
-		fmt.Println("raw accesstoken cookie string", accessTokenCookie)
-		fmt.Println("cookie value", accessTokenCookie.Value)
 
-		accessToken := AccessToken{}
-		token, err := jwt.ParseWithClaims(accessTokenCookie.Value, &accessToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte("temp key"), nil
+		// the claim is only updated on the next refresh, look at the user
+		// so a freshly verified email is honoured straight away
+		user, err := am.AuthRepository.FindUserById(accessToken.UserId, c.Request().Context())
+		if err == nil && user.EmailVerified {
+			return next(c)
+		}
+		return c.JSON(http.StatusForbidden, web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusForbidden,
+			Error: web.Error{
+				Message: "please verify your email address first",
+			},
 		})
-		fmt.Println("decoded token aid", accessToken.AccessTokenId)
-		fmt.Println("decoded token username", accessToken.Username)
+	}
+}
+
+// RequireSession keeps personal access tokens away from account management,
+// a leaked token must not be able to mint more tokens or sign the owner out.
+// Impersonation tokens are kept away too, support staff only get to look
+// around. It must run after AuthenticationRequired.
+func (am *AuthMiddleware) RequireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		accessToken, ok := c.Get("accessToken").(AccessToken)
+		if !ok {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		if accessToken.PersonalAccessTokenId != 0 {
+			return c.JSON(http.StatusForbidden, personalAccessTokenNotAllowedResponse)
+		}
+		if accessToken.Actor != nil {
+			return c.JSON(http.StatusForbidden, impersonationNotAllowedResponse)
+		}
+		return next(c)
+	}
+}
+
+func (am *AuthMiddleware) DeserializeUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rawAccessToken := bearerToken(c)
+		if rawAccessToken == "" {
+			rawAccessToken = am.config.Cookies.get(c, accessTokenCookie)
+			// personal access tokens only work in the Authorization header
+			if rawAccessToken == "" || strings.HasPrefix(rawAccessToken, PERSONAL_ACCESS_TOKEN_PREFIX) {
+				return next(c)
+			}
+		}
 
-		fmt.Println("decoded token", token)
+		accessToken, err := activeAccessToken(am.AuthRepository, am.keyRing, rawAccessToken, c.Request().Context())
 		if err != nil {
-			fmt.Println(err)
 			return next(c)
 		}
-		fmt.Println("final access token", accessToken)
-		c.Set("accessToken", accessToken)
+		if accessToken.Actor != nil {
+			c.Response().Header().Set(IMPERSONATED_BY_HEADER_NAME, impersonatedBy(accessToken.Actor))
+		}
+		c.Set("accessToken", *accessToken)
 		return next(c)
 	}
 }
+
+// bearerToken returns the token of an "Authorization: Bearer <jwt>" header,
+// it takes precedence over the accessToken cookie when both are sent.
+func bearerToken(c echo.Context) string {
+	scheme, token, found := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+)
+
+// OIDCProvider is an openid connect identity provider users can sign in
+// with using the authorization code flow with PKCE. Any spec compliant
+// provider works, including a mock provider running on localhost.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]any
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// OIDCIdentity is what we learned about the user from the id token.
+type OIDCIdentity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type oidcIDTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     any    `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+func NewOIDCProvider(name, issuer, clientId, clientSecret, redirectURL string, scopes []string) *OIDCProvider {
+	return &OIDCProvider{
+		Name:         name,
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		httpClient:   &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// NewOIDCProvidersFromEnv reads the comma separated provider names in
+// OIDC_PROVIDERS, then OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_REDIRECT_URL and optionally
+// OIDC_<NAME>_SCOPES for each of them.
+func NewOIDCProvidersFromEnv() (map[string]*OIDCProvider, error) {
+	providers := map[string]*OIDCProvider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		issuer := os.Getenv(prefix + "ISSUER")
+		clientId := os.Getenv(prefix + "CLIENT_ID")
+		redirectURL := os.Getenv(prefix + "REDIRECT_URL")
+		if issuer == "" || clientId == "" || redirectURL == "" {
+			return nil, fmt.Errorf("%vISSUER, %vCLIENT_ID and %vREDIRECT_URL are required", prefix, prefix, prefix)
+		}
+		scopes := strings.Fields(lib.GetEnv(prefix+"SCOPES", "openid email profile"))
+		providers[name] = NewOIDCProvider(name, issuer, clientId, os.Getenv(prefix+"CLIENT_SECRET"), redirectURL, scopes)
+	}
+	return providers, nil
+}
+
+// AuthCodeURL is where the browser is sent to sign in at the provider.
+func (op *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := op.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", op.ClientId)
+	query.Set("redirect_uri", op.RedirectURL)
+	query.Set("scope", strings.Join(op.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns the
+// verified identity from the id token.
+func (op *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*OIDCIdentity, error) {
+	discovery, err := op.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", op.RedirectURL)
+	form.Set("client_id", op.ClientId)
+	form.Set("code_verifier", codeVerifier)
+	if op.ClientSecret != "" {
+		form.Set("client_secret", op.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := op.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered with status %v", res.StatusCode)
+	}
+
+	tokenResponse := struct {
+		IdToken string `json:"id_token"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return nil, err
+	}
+	if tokenResponse.IdToken == "" {
+		return nil, errors.New("token endpoint did not return an id token")
+	}
+	return op.verifyIDToken(ctx, tokenResponse.IdToken, nonce)
+}
+
+func (op *OIDCProvider) verifyIDToken(ctx context.Context, rawIdToken string, nonce string) (*OIDCIdentity, error) {
+	claims := &oidcIDTokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		rawIdToken,
+		claims,
+		func(t *jwt.Token) (interface{}, error) { return op.verificationKey(ctx, t) },
+		jwt.WithIssuer(op.Issuer),
+		jwt.WithAudience(op.ClientId),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("id token has no expiry")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	// a few providers send email_verified as a string
+	emailVerified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return &OIDCIdentity{
+		Provider:          op.Name,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     emailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (op *OIDCProvider) verificationKey(ctx context.Context, t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, err := op.getKey(ctx, kid, false)
+	if err != nil {
+		// the provider may have rotated its keys since we last looked
+		key, err = op.getKey(ctx, kid, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+	case ed25519.PublicKey:
+		if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+	}
+	return key, nil
+}
+
+func (op *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.discovery != nil {
+		return op.discovery, nil
+	}
+
+	discovery := &oidcDiscovery{}
+	err := op.getJSON(ctx, op.Issuer+"/.well-known/openid-configuration", discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != op.Issuer {
+		return nil, fmt.Errorf("provider issuer %v does not match the configured %v", discovery.Issuer, op.Issuer)
+	}
+	op.discovery = discovery
+	return discovery, nil
+}
+
+func (op *OIDCProvider) getKey(ctx context.Context, kid string, refresh bool) (any, error) {
+	discovery, err := op.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	// do not let tokens with made up key ids make us hammer the provider
+	canRefresh := time.Since(op.keysFetchedAt) > time.Minute
+	if op.keys == nil || (refresh && canRefresh) {
+		keySet := struct {
+			Keys []JSONWebKey `json:"keys"`
+		}{}
+		if err = op.getJSON(ctx, discovery.JwksURI, &keySet); err != nil {
+			return nil, err
+		}
+		op.keys = map[string]any{}
+		for _, jwk := range keySet.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			if publicKey, err := jwk.publicKey(); err == nil {
+				op.keys[jwk.Kid] = publicKey
+			}
+		}
+		op.keysFetchedAt = time.Now()
+	}
+
+	if key, ok := op.keys[kid]; ok {
+		return key, nil
+	}
+	// tokens may leave out the kid when the provider only has one key
+	if kid == "" && len(op.keys) == 1 {
+		for _, key := range op.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func (op *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := op.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v answered with status %v", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (jwk JSONWebKey) publicKey() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", jwk.Kty)
+	}
+}
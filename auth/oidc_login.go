@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const OIDC_STATE_PURPOSE = "oidc_state"
+const OIDC_STATE_TTL = time.Minute * 10
+
+// OIDCState travels in a short lived cookie between redirecting to the
+// provider and the provider redirecting back, it is signed so it cannot be
+// tampered with.
+type OIDCState struct {
+	Purpose      string `json:"purpose"`
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	// LinkUserId is set when a signed in user links the provider account
+	// to their existing account instead of signing in with it
+	LinkUserId int64 `json:"linkUserId,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var usernameDisallowedCharacters = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// StartOIDCSignIn returns the provider url to redirect to and the state
+// token that must be handed back to FinishOIDCSignIn.
+func (asi *AuthServiceImpl) StartOIDCSignIn(providerName string, linkUserId int64, ctx context.Context) (string, string, *web.Response) {
+	provider, ok := asi.oidcProviders[providerName]
+	if !ok {
+		return "", "", &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "unknown identity provider",
+			},
+		}
+	}
+
+	state := &OIDCState{
+		Purpose:      OIDC_STATE_PURPOSE,
+		Provider:     provider.Name,
+		State:        newTokenId(),
+		Nonce:        newTokenId(),
+		CodeVerifier: newCodeVerifier(),
+		LinkUserId:   linkUserId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(OIDC_STATE_TTL)),
+		},
+	}
+	stateToken, err := asi.keyRing.Sign(state, JWT_TYPE_OIDC_STATE)
+	if err != nil {
+		return "", "", &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: "failed to start sign in, please try again",
+			},
+		}
+	}
+	redirectURL, err := provider.AuthCodeURL(ctx, state.State, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		lib.ErrorLog("start_oidc_sign_in_service", "failed to reach identity provider", err)
+		return "", "", &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadGateway,
+			Error: web.Error{
+				Message: "identity provider is not available, please try again later",
+			},
+		}
+	}
+	return redirectURL, stateToken, nil
+}
+
+// FinishOIDCSignIn handles the redirect back from the provider. Users are
+// signed in with the linked account, or a new account is created the first
+// time they use the provider. When the sign in was started to link an
+// account no tokens are returned, only a response.
+func (asi *AuthServiceImpl) FinishOIDCSignIn(
+	providerName, code, state, stateToken string, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_IN_OIDC, Detail: providerName}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	invalidState := &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusBadRequest,
+		Error: web.Error{
+			Message: "sign in has expired, please try again",
+		},
+	}
+	provider, ok := asi.oidcProviders[providerName]
+	if !ok {
+		return nil, nil, invalidState
+	}
+	savedState := &OIDCState{}
+	err := asi.keyRing.Parse(stateToken, savedState, JWT_TYPE_OIDC_STATE)
+	if err != nil || savedState.Purpose != OIDC_STATE_PURPOSE || savedState.Provider != provider.Name ||
+		subtle.ConstantTimeCompare([]byte(savedState.State), []byte(state)) != 1 || code == "" {
+		return nil, nil, invalidState
+	}
+
+	identity, err := provider.Exchange(ctx, code, savedState.CodeVerifier, savedState.Nonce)
+	if err != nil {
+		lib.ErrorLog("finish_oidc_sign_in_service", "failed to verify identity provider response", err)
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusUnauthorized,
+			Error: web.Error{
+				Message: "could not sign in with " + provider.Name + ", please try again",
+			},
+		}
+	}
+
+	if savedState.LinkUserId != 0 {
+		event.Event = AUDIT_OIDC_LINK
+		event.UserId = savedState.LinkUserId
+		err = asi.AuthRepository.LinkIdentity(savedState.LinkUserId, identity, ctx)
+		if err != nil {
+			return nil, nil, &web.Response{
+				Status: web.STATUS_FAIL,
+				Code:   http.StatusConflict,
+				Error: web.Error{
+					Message: err.Error(),
+				},
+			}
+		}
+		return nil, nil, &web.Response{
+			Status: web.STATUS_SUCCESS,
+			Code:   http.StatusOK,
+		}
+	}
+
+	user, err := asi.AuthRepository.FindUserByIdentity(identity.Provider, identity.Subject, ctx)
+	if err != nil {
+		user, err = asi.createUserFromIdentity(identity, ctx)
+	}
+	if err != nil {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	event.UserId = user.Id
+	event.Username = user.Username
+
+	if user.TotpEnabled {
+		return nil, nil, asi.newTwoFactorChallenge(user, ctx)
+	}
+	return asi.issueTokens(user, "", ctx)
+}
+
+// createUserFromIdentity never links to an existing account by email, that
+// would let anybody who controls the email at the provider take the account
+// over. Users link providers themselves while signed in instead.
+func (asi *AuthServiceImpl) createUserFromIdentity(identity *OIDCIdentity, ctx context.Context) (*User, error) {
+	username := identity.PreferredUsername
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+	username = truncate(usernameDisallowedCharacters.ReplaceAllString(username, ""), 32)
+	if username == "" {
+		username = identity.Provider + "-user"
+	}
+
+	newUser := &User{
+		Username: username,
+		Role:     ROLE_AUTHOR,
+	}
+	if identity.EmailVerified {
+		newUser.Email = identity.Email
+		newUser.EmailVerified = true
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		user, err := asi.AuthRepository.CreateUserWithIdentity(newUser, identity, ctx)
+		switch {
+		case err == nil:
+			return user, nil
+		case errors.Is(err, ErrUsernameTaken):
+			suffix, _ := rand.Int(rand.Reader, big.NewInt(10000))
+			newUser.Username = fmt.Sprintf("%v-%04d", truncate(username, 27), suffix)
+		case errors.Is(err, ErrEmailTaken):
+			return nil, errors.New(
+				"an account with this email already exists, sign in to it and link your " + identity.Provider + " account instead",
+			)
+		default:
+			return nil, err
+		}
+	}
+	return nil, errors.New("failed to create account, please try again")
+}
+
+// newCodeVerifier returns a PKCE code verifier as described in RFC 7636
+func newCodeVerifier() string {
+	verifier, _ := newSecretToken()
+	return verifier
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOIDCProvider serves discovery, the key set and a token endpoint that
+// hands out an id token for mockOIDCCode, which is all the authorization
+// code flow needs from a provider.
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+	// codeChallenge is the PKCE challenge of the last authorization request,
+	// the token endpoint checks the verifier against it
+	codeChallenge string
+	// claims are put in the id token, nonce and exp are filled in when left
+	// out
+	claims jwt.MapClaims
+	nonce  string
+}
+
+const mockOIDCCode = "authorization-code"
+const mockOIDCClientId = "blog-api"
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                mock.server.URL,
+			AuthorizationEndpoint: mock.server.URL + "/authorize",
+			TokenEndpoint:         mock.server.URL + "/token",
+			JwksURI:               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{{
+			Kty: "RSA",
+			Kid: "mock",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", mock.token)
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+func (mock *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != mockOIDCCode ||
+		r.PostFormValue("client_id") != mockOIDCClientId ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != mock.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   mock.server.URL,
+		"aud":   mockOIDCClientId,
+		"nonce": mock.nonce,
+		"exp":   time.Now().Add(time.Minute * 5).Unix(),
+	}
+	for name, value := range mock.claims {
+		claims[name] = value
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = "mock"
+	signed, _ := idToken.SignedString(mock.key)
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// authorize plays the browser visiting the authorization endpoint, it
+// returns the state the provider sends back to the callback.
+func (mock *mockOIDCProvider) authorize(t *testing.T, redirectURL string, claims jwt.MapClaims) string {
+	t.Helper()
+	authorization, err := url.Parse(redirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorization.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request has no S256 code challenge: %v", redirectURL)
+	}
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.codeChallenge = query.Get("code_challenge")
+	mock.nonce = query.Get("nonce")
+	mock.claims = claims
+	return query.Get("state")
+}
+
+func newOIDCTestService(t *testing.T, repository AuthRepository) (*AuthServiceImpl, *mockOIDCProvider) {
+	t.Helper()
+	mock := newMockOIDCProvider(t)
+	provider := NewOIDCProvider(
+		"mock", mock.server.URL, mockOIDCClientId, "", "http://localhost/api/oidc/mock/callback", []string{"openid", "email"},
+	)
+	authService := newTestService(repository, Config{
+		OIDCProviders: map[string]*OIDCProvider{"mock": provider},
+	})
+	return authService, mock
+}
+
+func TestFinishOIDCSignIn(t *testing.T) {
+	existingUser := &User{Id: 1, Username: "someone", Email: "someone@example.com", EmailVerified: true, Role: ROLE_AUTHOR}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		// tamper changes what reaches the callback
+		tamper   func(state, stateToken, challenge string) (string, string, string)
+		wantCode int
+	}{
+		{
+			name:     "first sign in creates an account",
+			claims:   jwt.MapClaims{"sub": "new-subject", "email": "new@example.com", "email_verified": true, "preferred_username": "newcomer"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:   "state mismatch",
+			claims: jwt.MapClaims{"sub": "new-subject"},
+			tamper: func(state, stateToken, challenge string) (string, string, string) {
+				return "forged", stateToken, challenge
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "missing state cookie",
+			claims: jwt.MapClaims{"sub": "new-subject"},
+			tamper: func(state, stateToken, challenge string) (string, string, string) {
+				return state, "", challenge
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "code verifier does not match the challenge",
+			claims: jwt.MapClaims{"sub": "new-subject"},
+			tamper: func(state, stateToken, challenge string) (string, string, string) {
+				return state, stateToken, "another challenge"
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "nonce mismatch",
+			claims:   jwt.MapClaims{"sub": "new-subject", "nonce": "replayed"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong issuer",
+			claims:   jwt.MapClaims{"sub": "new-subject", "iss": "https://attacker.example"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong audience",
+			claims:   jwt.MapClaims{"sub": "new-subject", "aud": "another-client"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "expired id token",
+			claims:   jwt.MapClaims{"sub": "new-subject", "exp": time.Now().Add(-time.Hour).Unix()},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "matching email does not link the existing account",
+			claims:   jwt.MapClaims{"sub": "other-subject", "email": "someone@example.com", "email_verified": true},
+			wantCode: http.StatusConflict,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			copiedUser := *existingUser
+			repository := newMemoryAuthRepository(&copiedUser)
+			authService, mock := newOIDCTestService(t, repository)
+			ctx := context.Background()
+
+			redirectURL, stateToken, errorResponse := authService.StartOIDCSignIn("mock", 0, ctx)
+			if errorResponse != nil {
+				t.Fatalf("start sign in: %v", errorResponse.Error.Message)
+			}
+			state := mock.authorize(t, redirectURL, test.claims)
+			if test.tamper != nil {
+				var challenge string
+				state, stateToken, challenge = test.tamper(state, stateToken, mock.codeChallenge)
+				mock.codeChallenge = challenge
+			}
+
+			accessToken, refreshToken, response := authService.FinishOIDCSignIn("mock", mockOIDCCode, state, stateToken, ctx)
+			if test.wantCode != http.StatusOK {
+				if response == nil || response.Code != test.wantCode {
+					t.Fatalf("got %+v, want status %d", response, test.wantCode)
+				}
+				if accessToken != nil || refreshToken != nil {
+					t.Fatal("tokens were issued for a rejected sign in")
+				}
+				if len(repository.users) != 1 || len(repository.identities) != 0 {
+					t.Fatalf("rejected sign in changed the accounts: %d users, %d identities",
+						len(repository.users), len(repository.identities))
+				}
+				return
+			}
+
+			if response != nil {
+				t.Fatalf("got %+v, want tokens", response)
+			}
+			user := repository.users[accessToken.UserId]
+			if user == nil || user.Id == existingUser.Id {
+				t.Fatalf("signed in as %+v, want a new account", user)
+			}
+			if user.Username != "newcomer" || user.Email != "new@example.com" || !user.EmailVerified || user.Password != "" {
+				t.Fatalf("new account is %+v", user)
+			}
+			if refreshToken == nil || repository.refreshTokens[refreshToken.RefreshTokenId] == nil {
+				t.Fatal("no refresh token was stored")
+			}
+
+			// the second sign in finds the account through the identity
+			redirectURL, stateToken, _ = authService.StartOIDCSignIn("mock", 0, ctx)
+			state = mock.authorize(t, redirectURL, test.claims)
+			accessToken, _, response = authService.FinishOIDCSignIn("mock", mockOIDCCode, state, stateToken, ctx)
+			if response != nil || accessToken.UserId != user.Id || len(repository.users) != 2 {
+				t.Fatalf("second sign in: got %+v, want user %d without a new account", response, user.Id)
+			}
+		})
+	}
+}
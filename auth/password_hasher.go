@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_HASH_ARGON2ID = "argon2id"
+	PASSWORD_HASH_BCRYPT   = "bcrypt"
+)
+
+// PasswordHashAlgorithm is one way of hashing passwords, the hashes it makes
+// carry everything needed to verify them, including the parameters.
+type PasswordHashAlgorithm interface {
+	// Handles reports whether hash was made by this algorithm
+	Handles(hash string) bool
+	Hash(password string) (string, error)
+	Verify(hash string, password string) bool
+	// Outdated reports whether hash was made with other parameters than the
+	// ones Hash uses now
+	Outdated(hash string) bool
+}
+
+type BcryptAlgorithm struct {
+	Cost int
+}
+
+func (ba BcryptAlgorithm) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (ba BcryptAlgorithm) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), ba.Cost)
+	return string(hash), err
+}
+
+func (ba BcryptAlgorithm) Verify(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (ba BcryptAlgorithm) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != ba.Cost
+}
+
+// Argon2idAlgorithm encodes its hashes the same way the reference
+// implementation does: $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2idAlgorithm struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (aa Argon2idAlgorithm) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (aa Argon2idAlgorithm) Hash(password string) (string, error) {
+	salt := make([]byte, aa.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, aa.Iterations, aa.Memory, aa.Parallelism, aa.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, aa.Memory, aa.Iterations, aa.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (aa Argon2idAlgorithm) Verify(hash string, password string) bool {
+	decoded, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey(
+		[]byte(password), decoded.salt, decoded.iterations, decoded.memory, decoded.parallelism, uint32(len(decoded.key)),
+	)
+	return subtle.ConstantTimeCompare(key, decoded.key) == 1
+}
+
+func (aa Argon2idAlgorithm) Outdated(hash string) bool {
+	decoded, err := decodeArgon2idHash(hash)
+	return err != nil || decoded.memory != aa.Memory || decoded.iterations != aa.Iterations ||
+		decoded.parallelism != aa.Parallelism || uint32(len(decoded.salt)) != aa.SaltLength ||
+		uint32(len(decoded.key)) != aa.KeyLength
+}
+
+func decodeArgon2idHash(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("not an argon2id hash")
+	}
+	version := 0
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+
+	decoded := &argon2idHash{}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &decoded.memory, &decoded.iterations, &decoded.parallelism)
+	if err != nil {
+		return nil, err
+	}
+	// argon2.IDKey panics on zero iterations or parallelism
+	if decoded.iterations < 1 || decoded.parallelism < 1 {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+	if decoded.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if decoded.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	// an empty key would match the empty key derived for any password
+	if len(decoded.key) == 0 {
+		return nil, errors.New("argon2id hash has no key")
+	}
+	return decoded, nil
+}
+
+// PasswordHasher hashes new passwords with the current algorithm and still
+// verifies hashes made by every other supported algorithm, NeedsRehash tells
+// when a stored hash should be replaced.
+type PasswordHasher struct {
+	current    PasswordHashAlgorithm
+	algorithms []PasswordHashAlgorithm
+}
+
+// NewPasswordHasher hashes with current, previous are only used to verify
+// existing hashes.
+func NewPasswordHasher(current PasswordHashAlgorithm, previous ...PasswordHashAlgorithm) *PasswordHasher {
+	return &PasswordHasher{
+		current:    current,
+		algorithms: append([]PasswordHashAlgorithm{current}, previous...),
+	}
+}
+
+func NewPasswordHasherFromEnv() (*PasswordHasher, error) {
+	bcryptAlgorithm := BcryptAlgorithm{
+		Cost: lib.GetEnvInt("BCRYPT_COST", 12),
+	}
+	argon2idAlgorithm := Argon2idAlgorithm{
+		Memory:      uint32(lib.GetEnvInt("ARGON2ID_MEMORY_KIB", 19*1024)),
+		Iterations:  uint32(lib.GetEnvInt("ARGON2ID_ITERATIONS", 2)),
+		Parallelism: uint8(lib.GetEnvInt("ARGON2ID_PARALLELISM", 1)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	if bcryptAlgorithm.Cost < bcrypt.MinCost || bcryptAlgorithm.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if argon2idAlgorithm.Memory < 8*uint32(argon2idAlgorithm.Parallelism) ||
+		argon2idAlgorithm.Iterations < 1 || argon2idAlgorithm.Parallelism < 1 {
+		return nil, errors.New("ARGON2ID_MEMORY_KIB, ARGON2ID_ITERATIONS and ARGON2ID_PARALLELISM are invalid")
+	}
+
+	switch algorithm := lib.GetEnv("PASSWORD_HASH_ALGORITHM", PASSWORD_HASH_ARGON2ID); algorithm {
+	case PASSWORD_HASH_ARGON2ID:
+		return NewPasswordHasher(argon2idAlgorithm, bcryptAlgorithm), nil
+	case PASSWORD_HASH_BCRYPT:
+		return NewPasswordHasher(bcryptAlgorithm, argon2idAlgorithm), nil
+	default:
+		return nil, errors.New("PASSWORD_HASH_ALGORITHM must be argon2id or bcrypt, got " + algorithm)
+	}
+}
+
+func (ph *PasswordHasher) Hash(password string) (string, error) {
+	return ph.current.Hash(password)
+}
+
+// Verify reports whether password matches hash, whichever supported
+// algorithm made it.
+func (ph *PasswordHasher) Verify(hash string, password string) bool {
+	for _, algorithm := range ph.algorithms {
+		if algorithm.Handles(hash) {
+			return algorithm.Verify(hash, password)
+		}
+	}
+	return false
+}
+
+// NeedsRehash reports whether hash was made by another algorithm than the
+// current one or with outdated parameters.
+func (ph *PasswordHasher) NeedsRehash(hash string) bool {
+	return !ph.current.Handles(hash) || ph.current.Outdated(hash)
+}
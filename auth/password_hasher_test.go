@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArgon2idAlgorithmVerify(t *testing.T) {
+	algorithm := Argon2idAlgorithm{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	hash, err := algorithm.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{name: "right password", hash: hash, password: "correct horse", want: true},
+		{name: "wrong password", hash: hash, password: "battery staple"},
+		{name: "zero parallelism", hash: strings.Replace(hash, "p=1", "p=0", 1), password: "correct horse"},
+		{name: "zero iterations", hash: strings.Replace(hash, "t=1", "t=0", 1), password: "correct horse"},
+		{name: "empty key", hash: strings.Join(append(parts[:5:5], ""), "$"), password: "anything"},
+		{name: "not base64 key", hash: strings.Join(append(parts[:5:5], "!"), "$"), password: "correct horse"},
+		{name: "other version", hash: strings.Replace(hash, "v=19", "v=16", 1), password: "correct horse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := algorithm.Verify(test.hash, test.password); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			// a hash that does not decode is never current, so it gets
+			// replaced on the next sign in
+			if !test.want && test.hash != hash && !algorithm.Outdated(test.hash) {
+				t.Fatal("malformed hash is not outdated")
+			}
+		})
+	}
+}
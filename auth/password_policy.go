@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+)
+
+// bcrypt silently ignores everything after the 72nd byte, longer passwords
+// would give a false sense of security
+const BCRYPT_MAX_PASSWORD_BYTES = 72
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BreachedPasswordDir holds a pwned passwords dump in the k-anonymity
+	// range format: one file per 5 character sha1 prefix, named PREFIX or
+	// PREFIX.txt, with a SUFFIX:COUNT line per breached password. Leave it
+	// empty to skip the check.
+	BreachedPasswordDir string
+}
+
+func NewPasswordPolicyFromEnv() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:           lib.GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:           lib.GetEnvInt("PASSWORD_MAX_LENGTH", BCRYPT_MAX_PASSWORD_BYTES),
+		RequireUpper:        lib.GetEnvBool("PASSWORD_REQUIRE_UPPER", false),
+		RequireLower:        lib.GetEnvBool("PASSWORD_REQUIRE_LOWER", false),
+		RequireDigit:        lib.GetEnvBool("PASSWORD_REQUIRE_DIGIT", false),
+		RequireSymbol:       lib.GetEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		BreachedPasswordDir: lib.GetEnv("PASSWORD_BREACHED_LIST_DIR", ""),
+	}
+}
+
+// Validate returns one detail per rule the password breaks, path is the name
+// of the field the password came from.
+func (pp PasswordPolicy) Validate(path string, password string) []lib.ErrorDetail {
+	errorDetails := []lib.ErrorDetail{}
+	addError := func(message string) {
+		errorDetails = append(errorDetails, lib.ErrorDetail{
+			Path:    []string{path},
+			Message: message,
+		})
+	}
+
+	maxLength := pp.MaxLength
+	if maxLength <= 0 || maxLength > BCRYPT_MAX_PASSWORD_BYTES {
+		maxLength = BCRYPT_MAX_PASSWORD_BYTES
+	}
+	if length := len([]rune(password)); length < pp.MinLength {
+		addError(path + " must be at least " + strconv.Itoa(pp.MinLength) + " characters long")
+	}
+	if len(password) > maxLength {
+		addError(path + " must not be longer than " + strconv.Itoa(maxLength) + " bytes")
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if pp.RequireUpper && !hasUpper {
+		addError(path + " must contain an uppercase letter")
+	}
+	if pp.RequireLower && !hasLower {
+		addError(path + " must contain a lowercase letter")
+	}
+	if pp.RequireDigit && !hasDigit {
+		addError(path + " must contain a digit")
+	}
+	if pp.RequireSymbol && !hasSymbol {
+		addError(path + " must contain a symbol")
+	}
+
+	if len(errorDetails) == 0 && pp.isBreached(password) {
+		addError(path + " has appeared in a data breach, please choose a different one")
+	}
+	return errorDetails
+}
+
+func (pp PasswordPolicy) isBreached(password string) bool {
+	if pp.BreachedPasswordDir == "" {
+		return false
+	}
+
+	hash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := hexHash[:5], hexHash[5:]
+
+	f, err := os.Open(filepath.Join(pp.BreachedPasswordDir, prefix+".txt"))
+	if err != nil {
+		f, err = os.Open(filepath.Join(pp.BreachedPasswordDir, prefix))
+	}
+	if err != nil {
+		lib.ErrorLog("check_breached_password", "breached password range file is missing", err)
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(lineSuffix, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// RequestPasswordReset answers the same way whether the user exists or not
+// so it cannot be used to find out which usernames are registered. Like
+// RequestMagicLink every request counts against the username and the ip
+// address.
+func (asi *AuthServiceImpl) RequestPasswordReset(data *PasswordResetRequest, ctx context.Context) *web.Response {
+	err := asi.v.Struct(data)
+	if err != nil {
+		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "validation error",
+				Detail:  validatedError,
+			},
+		}
+	}
+
+	errorResponse := asi.throttleRequests("too many password resets requested, please try again later", map[string]int{
+		"password_reset:" + strings.ToLower(data.Username): asi.config.PasswordResetMaxRequests,
+		"ip:" + clientInfoFromContext(ctx).IpAddress:       asi.config.LoginMaxAttemptsPerIp,
+	})
+	if errorResponse != nil {
+		return errorResponse
+	}
+
+	response := &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusAccepted,
+		Data: map[string]string{
+			"message": "if the account exists, a password reset link has been sent to its email address",
+		},
+	}
+
+	user, err := asi.AuthRepository.FindUserByUsername(&UserSignInRequest{Username: data.Username}, ctx)
+	if err != nil || user.Email == "" {
+		return response
+	}
+
+	// storing the token and sending in the background keeps the response
+	// time the same for existing and unknown users
+	go asi.sendPasswordReset(user)
+
+	return response
+}
+
+func (asi *AuthServiceImpl) sendPasswordReset(user *User) {
+	// the request is answered before this runs, its context is gone
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	token, tokenHash := newSecretToken()
+	err := asi.AuthRepository.CreateUserToken(&UserToken{
+		UserId:    user.Id,
+		Purpose:   USER_TOKEN_PASSWORD_RESET,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(asi.config.PasswordResetTokenTTL),
+	}, ctx)
+	if err != nil {
+		return
+	}
+
+	link := asi.config.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	asi.sendMail("request_password_reset_service", lib.Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Hi " + user.Username + ",\r\n\r\n" +
+			"Somebody asked to reset the password of your account. Open the link below to choose a new password, " +
+			"it expires in " + asi.config.PasswordResetTokenTTL.String() + ".\r\n\r\n" + link + "\r\n\r\n" +
+			"If it was not you, you can ignore this email.",
+	})
+}
+
+func (asi *AuthServiceImpl) ResetPassword(data *PasswordResetConfirmRequest, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_PASSWORD_RESET}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	err := asi.v.Struct(data)
+	if err != nil {
+		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "validation error",
+				Detail:  validatedError,
+			},
+		}
+	}
+
+	if errorResponse := asi.validatePassword("password", data.Password); errorResponse != nil {
+		return errorResponse
+	}
+
+	token, err := asi.AuthRepository.UseUserToken(hashSecretToken(data.Token), USER_TOKEN_PASSWORD_RESET, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	event.UserId = token.UserId
+
+	hashedPassword, err := asi.config.PasswordHasher.Hash(data.Password)
+	if err != nil {
+		return failedToHashPassword(err)
+	}
+	err = asi.AuthRepository.UpdateUserPassword(token.UserId, hashedPassword, ctx)
+	if err == nil {
+		// whoever knew the old password should not stay signed in
+		err = asi.AuthRepository.RevokeUserTokens(token.UserId, ctx)
+	}
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+	}
+}
+
+// ChangePassword keeps the session it is called from signed in, every other
+// session of the user is signed out.
+func (asi *AuthServiceImpl) ChangePassword(
+	accessToken *AccessToken, data *ChangePasswordRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_PASSWORD_CHANGE, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	if errorResponse := asi.validatePassword("password", data.Password); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	// a stolen session must not be usable to guess the current password
+	key := "change_password:" + strconv.FormatInt(user.Id, 10)
+	errorResponse := asi.throttleAttempts(key, func() error {
+		// accounts created through an identity provider have no password
+		// and can only get one through a password reset
+		if user.Password == "" || !asi.config.PasswordHasher.Verify(user.Password, data.CurrentPassword) {
+			return errors.New("current password is incorrect")
+		}
+		return nil
+	})
+	if errorResponse != nil {
+		return errorResponse
+	}
+
+	hashedPassword, err := asi.config.PasswordHasher.Hash(data.Password)
+	if err != nil {
+		return failedToHashPassword(err)
+	}
+	err = asi.AuthRepository.UpdateUserPassword(user.Id, hashedPassword, ctx)
+	if err == nil {
+		err = asi.AuthRepository.RevokeOtherSessions(user.Id, accessToken.SessionId, ctx)
+	}
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+	}
+}
+
+func (asi *AuthServiceImpl) sendMail(action string, mail lib.Mail) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := asi.mailer.Send(ctx, mail); err != nil {
+		lib.ErrorLog(action, "failed to send mail", err)
+	}
+}
+
+// newSecretToken returns a random token to hand to the user and the hash
+// that is stored in place of it.
+func newSecretToken() (string, string) {
+	token := make([]byte, 32)
+	rand.Read(token)
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+	return encoded, hashSecretToken(encoded)
+}
+
+func hashSecretToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+// PERSONAL_ACCESS_TOKEN_PREFIX tells personal access tokens apart from jwts
+// in the Authorization header and makes leaked tokens easy to search for.
+const PERSONAL_ACCESS_TOKEN_PREFIX = "gba_pat_"
+const PERSONAL_ACCESS_TOKEN_DEFAULT_TTL_DAYS = 90
+
+// CreatePersonalAccessToken can only grant scopes the role of the user has.
+func (asi *AuthServiceImpl) CreatePersonalAccessToken(
+	accessToken *AccessToken, data *CreatePersonalAccessTokenRequest, ctx context.Context,
+) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	for _, scope := range data.Scopes {
+		if !HasPermission(accessToken.Role, scope) {
+			return &web.Response{
+				Status: web.STATUS_FAIL,
+				Code:   http.StatusForbidden,
+				Error: web.Error{
+					Message: "your role does not allow the requested scopes",
+					Detail: []lib.ErrorDetail{{
+						Path:    []string{"scopes"},
+						Value:   scope,
+						Message: "scope " + scope + " is not allowed for role " + accessToken.Role,
+					}},
+				},
+			}
+		}
+	}
+	if data.ExpiresInDays == 0 {
+		data.ExpiresInDays = PERSONAL_ACCESS_TOKEN_DEFAULT_TTL_DAYS
+	}
+
+	secret, tokenHash := newSecretToken()
+	slices.Sort(data.Scopes)
+	now := time.Now()
+	personalAccessToken := &PersonalAccessToken{
+		UserId:    accessToken.UserId,
+		Name:      data.Name,
+		Scopes:    slices.Compact(data.Scopes),
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, data.ExpiresInDays),
+	}
+	err := asi.AuthRepository.SavePersonalAccessToken(personalAccessToken, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusCreated,
+		Data: CreatedPersonalAccessTokenResponse{
+			PersonalAccessToken: *personalAccessToken,
+			Token:               PERSONAL_ACCESS_TOKEN_PREFIX + secret,
+		},
+	}
+}
+
+func (asi *AuthServiceImpl) GetPersonalAccessTokens(accessToken *AccessToken, ctx context.Context) *web.Response {
+	tokens, err := asi.AuthRepository.FindPersonalAccessTokensByUserId(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   tokens,
+	}
+}
+
+func (asi *AuthServiceImpl) RevokePersonalAccessToken(
+	accessToken *AccessToken, data *PersonalAccessTokenRequest, ctx context.Context,
+) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	err := asi.AuthRepository.RevokePersonalAccessToken(accessToken.UserId, data.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusNoContent,
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+func (asi *AuthServiceImpl) GetCurrentUser(accessToken *AccessToken, ctx context.Context) *web.Response {
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   user,
+	}
+}
+
+func (asi *AuthServiceImpl) UpdateProfile(
+	accessToken *AccessToken, data *UpdateProfileRequest, ctx context.Context,
+) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	if data.Avatar != nil && *data.Avatar != "" && !lib.UploadedFileExists(*data.Avatar) {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "validation error",
+				Detail: []lib.ErrorDetail{{
+					Path:    []string{"avatar"},
+					Value:   *data.Avatar,
+					Message: "avatar must be a file uploaded through the file upload endpoint",
+				}},
+			},
+		}
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	if data.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*data.DisplayName)
+	}
+	if data.Bio != nil {
+		user.Bio = strings.TrimSpace(*data.Bio)
+	}
+	if data.Website != nil {
+		user.Website = *data.Website
+	}
+	if data.Avatar != nil {
+		user.Avatar = *data.Avatar
+	}
+
+	err = asi.AuthRepository.UpdateUserProfile(user, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   user,
+	}
+}
@@ -4,13 +4,96 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
 	"github.com/zulfikarrosadi/go-blog-api/lib"
 )
 
 type AuthRepository interface {
 	FindUserByUsername(*UserSignInRequest, context.Context) (*User, error)
+	FindUserById(int64, context.Context) (*User, error)
+	FindUserByLogin(string, context.Context) (*User, error)
 	CreateUser(*UserSignUpRequest, context.Context) (*UserAuthResponse, error)
+	UpdateUserRole(*UpdateUserRoleRequest, context.Context) error
+	UpdateUserProfile(*User, context.Context) error
+	SaveRefreshToken(*RefreshToken, context.Context) error
+	FindRefreshTokenById(string, context.Context) (*StoredRefreshToken, error)
+	MarkRefreshTokenUsed(string, context.Context) error
+	RevokeRefreshTokenFamily(string, context.Context) error
+	RevokeAccessToken(*AccessToken, context.Context) error
+	RevokeUserTokens(int64, context.Context) error
+	RevokeOtherSessions(int64, string, context.Context) error
+	IsAccessTokenRevoked(*AccessToken, context.Context) (bool, error)
+	UpdateUserPassword(int64, string, context.Context) error
+	MarkEmailVerified(int64, context.Context) error
+	UpdateUserEmail(int64, string, context.Context) error
+	CreateUserToken(*UserToken, context.Context) error
+	UseUserToken(string, string, context.Context) (*UserToken, error)
+	FindUserToken(string, string, context.Context) (*UserToken, error)
+	SaveTotpSecret(int64, string, context.Context) error
+	EnableTotp(int64, []string, context.Context) error
+	DisableTotp(int64, context.Context) error
+	UseTotpStep(int64, int64, context.Context) error
+	UseRecoveryCode(int64, string, context.Context) error
+	SaveSession(*Session, context.Context) error
+	TouchSession(*Session, context.Context) error
+	FindSessionsByUserId(int64, context.Context) ([]Session, error)
+	RevokeSession(int64, string, context.Context) error
+	FindUserByIdentity(string, string, context.Context) (*User, error)
+	CreateUserWithIdentity(*User, *OIDCIdentity, context.Context) (*User, error)
+	LinkIdentity(int64, *OIDCIdentity, context.Context) error
+	SavePersonalAccessToken(*PersonalAccessToken, context.Context) error
+	FindPersonalAccessTokensByUserId(int64, context.Context) ([]PersonalAccessToken, error)
+	FindPersonalAccessTokenByHash(string, context.Context) (*PersonalAccessToken, error)
+	TouchPersonalAccessToken(int64, context.Context) error
+	RevokePersonalAccessToken(int64, int64, context.Context) error
+	ScheduleUserDeletion(*ScheduledDeletion, context.Context) error
+	CancelUserDeletion(int64, context.Context) error
+	FindScheduledDeletions(time.Time, context.Context) ([]ScheduledDeletion, error)
+	FindPlaceholderUserId(*sql.Tx, context.Context) (int64, error)
+	LockScheduledDeletion(*sql.Tx, int64, context.Context) error
+	DeleteUser(*sql.Tx, int64, context.Context) error
+	FindUsers(*UserListRequest, context.Context) ([]User, int, error)
+	SuspendUser(int64, string, int64, context.Context) error
+	UnsuspendUser(int64, context.Context) error
+	SaveAuditEvent(*AuditEvent, context.Context) error
+	FindAuditEvents(*AuditEventFilter, context.Context) ([]AuditEvent, int, error)
+	ExportAuditEvents(*AuditEventFilter, func(*AuditEvent) error, context.Context) error
+}
+
+var (
+	ErrDeletionCancelled = errors.New("account deletion has been cancelled")
+	ErrUsernameTaken     = errors.New("this username is already in use. please use a different username or try logging in")
+	ErrEmailTaken        = errors.New("this email is already in use. please use a different email or try logging in")
+)
+
+// userColumns is the column list scanUser expects
+const userColumns = `id, username, COALESCE(email, ''), email_verified_at IS NOT NULL, password, role,
+	COALESCE(totp_secret, ''), totp_enabled_at IS NOT NULL, display_name, bio, website, avatar,
+	deletion_scheduled_at, suspended_at, suspension_reason, created_at`
+
+func scanUser(scan func(dest ...any) error) (*User, error) {
+	user := &User{}
+	deletionScheduledAt := sql.NullTime{}
+	suspendedAt := sql.NullTime{}
+	err := scan(
+		&user.Id, &user.Username, &user.Email, &user.EmailVerified, &user.Password, &user.Role,
+		&user.TotpSecret, &user.TotpEnabled, &user.DisplayName, &user.Bio, &user.Website, &user.Avatar,
+		&deletionScheduledAt, &suspendedAt, &user.SuspensionReason, &user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deletionScheduledAt.Valid {
+		user.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
+	if suspendedAt.Valid {
+		user.SuspendedAt = &suspendedAt.Time
+	}
+	return user, nil
 }
 
 type AuthRepositoryImpl struct {
@@ -26,28 +109,1031 @@ func NewAuthRepository(connection *sql.DB) *AuthRepositoryImpl {
 func (as *AuthRepositoryImpl) CreateUser(
 	data *UserSignUpRequest, ctx context.Context,
 ) (*UserAuthResponse, error) {
-	q := "INSERT INTO users (username, password) VALUES (?,?)"
-	r, err := as.DB.ExecContext(ctx, q, data.Username, data.Password)
+	q := "INSERT INTO users (username, email, password, role) VALUES (?,?,?,?)"
+	r, err := as.DB.ExecContext(ctx, q, data.Username, data.Email, data.Password, ROLE_AUTHOR)
 	if err != nil {
 		lib.ValidateErrorV2("craete_user_repo", err)
-		return nil, errors.New("this username is already in use. please use a different username or try logging in")
+		if isDuplicateEntry(err, "idx_users_email") {
+			return nil, ErrEmailTaken
+		}
+		return nil, ErrUsernameTaken
 	}
 	i, _ := r.LastInsertId()
 
 	return &UserAuthResponse{
 		UserId:   i,
 		Username: data.Username,
+		Email:    data.Email,
+		Role:     ROLE_AUTHOR,
 	}, nil
 }
 
 func (as *AuthRepositoryImpl) FindUserByUsername(data *UserSignInRequest, ctx context.Context) (*User, error) {
-	q := "SELECT id, username, password FROM users WHERE username = ?"
-	r := as.DB.QueryRowContext(ctx, q, data.Username)
-	user := &User{}
-	err := r.Scan(&user.Id, &user.Username, &user.Password)
+	q := "SELECT " + userColumns + " FROM users WHERE username = ?"
+	user, err := scanUser(as.DB.QueryRowContext(ctx, q, data.Username).Scan)
 	if err != nil {
 		lib.ValidateErrorV2("find_user_by_username_repo", err)
 		return nil, errors.New("username or password is incorrect")
 	}
 	return user, nil
 }
+
+func (as *AuthRepositoryImpl) FindUserById(id int64, ctx context.Context) (*User, error) {
+	q := "SELECT " + userColumns + " FROM users WHERE id = ?"
+	user, err := scanUser(as.DB.QueryRowContext(ctx, q, id).Scan)
+	if err != nil {
+		lib.ValidateErrorV2("find_user_by_id_repo", err)
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+// FindUserByLogin finds the user by username or by email address, a
+// username match wins.
+func (as *AuthRepositoryImpl) FindUserByLogin(login string, ctx context.Context) (*User, error) {
+	q := "SELECT " + userColumns + " FROM users WHERE username = ? OR email = ? ORDER BY username = ? DESC LIMIT 1"
+	user, err := scanUser(as.DB.QueryRowContext(ctx, q, login, login, login).Scan)
+	if err != nil {
+		lib.ValidateErrorV2("find_user_by_login_repo", err)
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+func (as *AuthRepositoryImpl) UpdateUserRole(data *UpdateUserRoleRequest, ctx context.Context) error {
+	q := "UPDATE users SET role = ? WHERE id = ?"
+	r, err := as.DB.ExecContext(ctx, q, data.Role, data.UserId)
+	if err != nil {
+		lib.ValidateErrorV2("update_user_role_repo", err)
+		return errors.New("failed to update user role, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		// mysql reports 0 affected rows when the role did not change, only
+		// call it missing when the user really does not exist
+		if _, err := as.FindUserById(data.UserId, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) UpdateUserProfile(data *User, ctx context.Context) error {
+	q := "UPDATE users SET display_name = ?, bio = ?, website = ?, avatar = ? WHERE id = ?"
+	_, err := as.DB.ExecContext(ctx, q, data.DisplayName, data.Bio, data.Website, data.Avatar, data.Id)
+	if err != nil {
+		lib.ValidateErrorV2("update_user_profile_repo", err)
+		return errors.New("failed to update profile, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) SaveRefreshToken(data *RefreshToken, ctx context.Context) error {
+	q := "INSERT INTO refresh_tokens (id, family_id, user_id, expires_at) VALUES (?,?,?,?)"
+	_, err := as.DB.ExecContext(ctx, q, data.RefreshTokenId, data.FamilyId, data.Id, data.ExpiresAt.Time)
+	if err != nil {
+		lib.ValidateErrorV2("save_refresh_token_repo", err)
+		return errors.New("failed to create session, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) FindRefreshTokenById(id string, ctx context.Context) (*StoredRefreshToken, error) {
+	q := "SELECT id, family_id, user_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE id = ?"
+	r := as.DB.QueryRowContext(ctx, q, id)
+	token := &StoredRefreshToken{}
+	err := r.Scan(&token.Id, &token.FamilyId, &token.UserId, &token.ExpiresAt, &token.UsedAt, &token.RevokedAt)
+	if err != nil {
+		lib.ValidateErrorV2("find_refresh_token_by_id_repo", err)
+		return nil, errors.New("refresh token invalid")
+	}
+	return token, nil
+}
+
+// MarkRefreshTokenUsed only succeeds for the first caller, so two concurrent
+// refreshes with the same token cannot both be rotated.
+func (as *AuthRepositoryImpl) MarkRefreshTokenUsed(id string, ctx context.Context) error {
+	q := "UPDATE refresh_tokens SET used_at = NOW() WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL"
+	r, err := as.DB.ExecContext(ctx, q, id)
+	if err != nil {
+		lib.ValidateErrorV2("mark_refresh_token_used_repo", err)
+		return errors.New("refresh token invalid")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("refresh token already used")
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily also ends the session the family belongs to.
+func (as *AuthRepositoryImpl) RevokeRefreshTokenFamily(familyId string, ctx context.Context) error {
+	q := "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL"
+	_, err := as.DB.ExecContext(ctx, q, familyId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_refresh_token_family_repo", err)
+		return errors.New("failed to revoke session")
+	}
+	q = "UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL"
+	_, err = as.DB.ExecContext(ctx, q, time.Now(), familyId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_refresh_token_family_repo", err)
+		return errors.New("failed to revoke session")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) RevokeAccessToken(data *AccessToken, ctx context.Context) error {
+	// entries past their expiry are useless since the token would be
+	// rejected anyway, clean them up while we are here
+	q := "DELETE FROM revoked_access_tokens WHERE expires_at < ?"
+	_, err := as.DB.ExecContext(ctx, q, time.Now())
+	if err != nil {
+		lib.ValidateErrorV2("revoke_access_token_repo", err)
+	}
+
+	q = "INSERT IGNORE INTO revoked_access_tokens (id, user_id, expires_at) VALUES (?,?,?)"
+	_, err = as.DB.ExecContext(ctx, q, data.AccessTokenId, data.UserId, data.ExpiresAt.Time)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_access_token_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	return nil
+}
+
+// RevokeUserTokens invalidates every refresh token and personal access token
+// of the user and every access token issued before now.
+func (as *AuthRepositoryImpl) RevokeUserTokens(userId int64, ctx context.Context) error {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	q = "UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, time.Now(), userId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	q = "UPDATE personal_access_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, time.Now(), userId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	// access tokens only carry second precision in their iat claim, so
+	// IsAccessTokenRevoked also rejects tokens issued within this second
+	q = "UPDATE users SET tokens_revoked_at = ? WHERE id = ?"
+	_, err = tx.ExecContext(ctx, q, time.Now().Truncate(time.Second), userId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("revoke_user_tokens_repo", err)
+		return errors.New("failed to sign out, please try again")
+	}
+	return nil
+}
+
+// RevokeOtherSessions signs the user out of every session but keepSessionId,
+// access tokens of those sessions stop working because their session is
+// revoked.
+func (as *AuthRepositoryImpl) RevokeOtherSessions(userId int64, keepSessionId string, ctx context.Context) error {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_other_sessions_repo", err)
+		return errors.New("failed to sign out other sessions, please try again")
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND family_id <> ? AND revoked_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, userId, keepSessionId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_other_sessions_repo", err)
+		return errors.New("failed to sign out other sessions, please try again")
+	}
+	q = "UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id <> ? AND revoked_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, time.Now(), userId, keepSessionId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_other_sessions_repo", err)
+		return errors.New("failed to sign out other sessions, please try again")
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("revoke_other_sessions_repo", err)
+		return errors.New("failed to sign out other sessions, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) IsAccessTokenRevoked(data *AccessToken, ctx context.Context) (bool, error) {
+	q := `SELECT
+		EXISTS (SELECT 1 FROM revoked_access_tokens WHERE id = ?)
+		OR EXISTS (SELECT 1 FROM users WHERE id = ? AND tokens_revoked_at >= ?)
+		OR EXISTS (SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NOT NULL)
+		OR NOT EXISTS (SELECT 1 FROM users WHERE id = ? AND suspended_at IS NULL)`
+	var issuedAt time.Time
+	if data.IssuedAt != nil {
+		issuedAt = data.IssuedAt.Time
+	}
+
+	revoked := false
+	err := as.DB.QueryRowContext(
+		ctx, q, data.AccessTokenId, data.UserId, issuedAt, data.SessionId, data.UserId,
+	).Scan(&revoked)
+	if err != nil {
+		lib.ValidateErrorV2("is_access_token_revoked_repo", err)
+		return false, err
+	}
+	return revoked, nil
+}
+
+func (as *AuthRepositoryImpl) UpdateUserPassword(userId int64, password string, ctx context.Context) error {
+	q := "UPDATE users SET password = ? WHERE id = ?"
+	_, err := as.DB.ExecContext(ctx, q, password, userId)
+	if err != nil {
+		lib.ValidateErrorV2("update_user_password_repo", err)
+		return errors.New("failed to update password, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) MarkEmailVerified(userId int64, ctx context.Context) error {
+	q := "UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL"
+	_, err := as.DB.ExecContext(ctx, q, time.Now(), userId)
+	if err != nil {
+		lib.ValidateErrorV2("mark_email_verified_repo", err)
+		return errors.New("failed to verify email, please try again")
+	}
+	return nil
+}
+
+// UpdateUserEmail also marks the email as unverified, the new address has to
+// be confirmed again.
+func (as *AuthRepositoryImpl) UpdateUserEmail(userId int64, email string, ctx context.Context) error {
+	q := "UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?"
+	_, err := as.DB.ExecContext(ctx, q, email, userId)
+	if err != nil {
+		lib.ValidateErrorV2("update_user_email_repo", err)
+		if isDuplicateEntry(err, "idx_users_email") {
+			return ErrEmailTaken
+		}
+		return errors.New("failed to update email, please try again")
+	}
+	return nil
+}
+
+// CreateUserToken also invalidates the tokens with the same purpose the user
+// still has, only the most recently sent link works.
+func (as *AuthRepositoryImpl) CreateUserToken(data *UserToken, ctx context.Context) error {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_token_repo", err)
+		return errors.New("failed to create token, please try again")
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL"
+	_, err = tx.ExecContext(ctx, q, time.Now(), data.UserId, data.Purpose)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_token_repo", err)
+		return errors.New("failed to create token, please try again")
+	}
+	q = "INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES (?,?,?,?)"
+	r, err := tx.ExecContext(ctx, q, data.UserId, data.Purpose, data.TokenHash, data.ExpiresAt)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_token_repo", err)
+		return errors.New("failed to create token, please try again")
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("create_user_token_repo", err)
+		return errors.New("failed to create token, please try again")
+	}
+	data.Id, _ = r.LastInsertId()
+	return nil
+}
+
+// UseUserToken consumes an unexpired token, each token can only be used once
+// even when the same link is opened concurrently.
+func (as *AuthRepositoryImpl) UseUserToken(tokenHash string, purpose string, ctx context.Context) (*UserToken, error) {
+	now := time.Now()
+	q := "UPDATE user_tokens SET used_at = ? WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?"
+	r, err := as.DB.ExecContext(ctx, q, now, tokenHash, purpose, now)
+	if err != nil {
+		lib.ValidateErrorV2("use_user_token_repo", err)
+		return nil, errors.New("link is invalid or has expired")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return nil, errors.New("link is invalid or has expired")
+	}
+
+	q = "SELECT id, user_id, purpose, token_hash, expires_at FROM user_tokens WHERE token_hash = ?"
+	token := &UserToken{}
+	err = as.DB.QueryRowContext(ctx, q, tokenHash).Scan(
+		&token.Id, &token.UserId, &token.Purpose, &token.TokenHash, &token.ExpiresAt,
+	)
+	if err != nil {
+		lib.ValidateErrorV2("use_user_token_repo", err)
+		return nil, errors.New("link is invalid or has expired")
+	}
+	return token, nil
+}
+
+// FindUserToken returns the token when it can still be used, without using
+// it.
+func (as *AuthRepositoryImpl) FindUserToken(tokenHash string, purpose string, ctx context.Context) (*UserToken, error) {
+	q := `SELECT id, user_id, purpose, token_hash, expires_at FROM user_tokens
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`
+	token := &UserToken{}
+	err := as.DB.QueryRowContext(ctx, q, tokenHash, purpose, time.Now()).Scan(
+		&token.Id, &token.UserId, &token.Purpose, &token.TokenHash, &token.ExpiresAt,
+	)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			lib.ValidateErrorV2("find_user_token_repo", err)
+		}
+		return nil, errors.New("link is invalid or has expired")
+	}
+	return token, nil
+}
+
+// SaveTotpSecret stores a secret that is waiting for its first code, two
+// factor stays disabled until EnableTotp is called.
+func (as *AuthRepositoryImpl) SaveTotpSecret(userId int64, secret string, ctx context.Context) error {
+	q := "UPDATE users SET totp_secret = ?, totp_last_used_step = NULL WHERE id = ? AND totp_enabled_at IS NULL"
+	r, err := as.DB.ExecContext(ctx, q, secret, userId)
+	if err != nil {
+		lib.ValidateErrorV2("save_totp_secret_repo", err)
+		return errors.New("failed to start two factor enrollment, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("two factor authentication is already enabled")
+	}
+	return nil
+}
+
+// EnableTotp turns two factor on and replaces the recovery codes of the user.
+func (as *AuthRepositoryImpl) EnableTotp(userId int64, recoveryCodeHashes []string, ctx context.Context) error {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("enable_totp_repo", err)
+		return errors.New("failed to enable two factor authentication, please try again")
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE users SET totp_enabled_at = ? WHERE id = ?"
+	_, err = tx.ExecContext(ctx, q, time.Now(), userId)
+	if err != nil {
+		lib.ValidateErrorV2("enable_totp_repo", err)
+		return errors.New("failed to enable two factor authentication, please try again")
+	}
+	q = "DELETE FROM totp_recovery_codes WHERE user_id = ?"
+	_, err = tx.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("enable_totp_repo", err)
+		return errors.New("failed to enable two factor authentication, please try again")
+	}
+	q = "INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?,?)"
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, q, userId, codeHash)
+		if err != nil {
+			lib.ValidateErrorV2("enable_totp_repo", err)
+			return errors.New("failed to enable two factor authentication, please try again")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("enable_totp_repo", err)
+		return errors.New("failed to enable two factor authentication, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) DisableTotp(userId int64, ctx context.Context) error {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("disable_totp_repo", err)
+		return errors.New("failed to disable two factor authentication, please try again")
+	}
+	defer tx.Rollback()
+
+	q := "UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL WHERE id = ?"
+	_, err = tx.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("disable_totp_repo", err)
+		return errors.New("failed to disable two factor authentication, please try again")
+	}
+	q = "DELETE FROM totp_recovery_codes WHERE user_id = ?"
+	_, err = tx.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("disable_totp_repo", err)
+		return errors.New("failed to disable two factor authentication, please try again")
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("disable_totp_repo", err)
+		return errors.New("failed to disable two factor authentication, please try again")
+	}
+	return nil
+}
+
+// UseTotpStep fails when a code of the same or a later step was already used.
+func (as *AuthRepositoryImpl) UseTotpStep(userId int64, step int64, ctx context.Context) error {
+	q := "UPDATE users SET totp_last_used_step = ? WHERE id = ? AND (totp_last_used_step IS NULL OR totp_last_used_step < ?)"
+	r, err := as.DB.ExecContext(ctx, q, step, userId, step)
+	if err != nil {
+		lib.ValidateErrorV2("use_totp_step_repo", err)
+		return errors.New("two factor code is incorrect")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("two factor code is incorrect")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) UseRecoveryCode(userId int64, codeHash string, ctx context.Context) error {
+	q := "UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL"
+	r, err := as.DB.ExecContext(ctx, q, time.Now(), userId, codeHash)
+	if err != nil {
+		lib.ValidateErrorV2("use_recovery_code_repo", err)
+		return errors.New("recovery code is incorrect")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("recovery code is incorrect")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) SaveSession(data *Session, ctx context.Context) error {
+	q := `INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES (?,?,?,?,?,?,?)`
+	_, err := as.DB.ExecContext(
+		ctx, q, data.Id, data.UserId, truncate(data.UserAgent, 512), data.IpAddress, data.CreatedAt, data.LastUsedAt, data.ExpiresAt,
+	)
+	if err != nil {
+		lib.ValidateErrorV2("save_session_repo", err)
+		return errors.New("failed to create session, please try again")
+	}
+	return nil
+}
+
+// TouchSession records that the session was just used, it fails when the
+// session has been revoked.
+func (as *AuthRepositoryImpl) TouchSession(data *Session, ctx context.Context) error {
+	q := `UPDATE sessions SET user_agent = ?, ip_address = ?, last_used_at = ?, expires_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL`
+	r, err := as.DB.ExecContext(
+		ctx, q, truncate(data.UserAgent, 512), data.IpAddress, data.LastUsedAt, data.ExpiresAt, data.Id, data.UserId,
+	)
+	if err != nil {
+		lib.ValidateErrorV2("touch_session_repo", err)
+		return errors.New("session has been revoked")
+	}
+	if affected, _ := r.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	// mysql does not count rows whose values did not change, which happens
+	// when the session is used twice within the same second
+	active := false
+	q = "SELECT revoked_at IS NULL FROM sessions WHERE id = ? AND user_id = ?"
+	err = as.DB.QueryRowContext(ctx, q, data.Id, data.UserId).Scan(&active)
+	if err != nil || !active {
+		return errors.New("session has been revoked")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) FindSessionsByUserId(userId int64, ctx context.Context) ([]Session, error) {
+	q := `SELECT id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`
+	r, err := as.DB.QueryContext(ctx, q, userId, time.Now())
+	if err != nil {
+		lib.ValidateErrorV2("find_sessions_by_user_id_repo", err)
+		return nil, errors.New("failed to get sessions, please try again")
+	}
+	defer r.Close()
+
+	sessions := []Session{}
+	for r.Next() {
+		session := Session{}
+		err = r.Scan(
+			&session.Id, &session.UserId, &session.UserAgent, &session.IpAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+		)
+		if err != nil {
+			lib.ValidateErrorV2("find_sessions_by_user_id_repo", err)
+			return nil, errors.New("failed to get sessions, please try again")
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// RevokeSession only revokes sessions that belong to userId.
+func (as *AuthRepositoryImpl) RevokeSession(userId int64, sessionId string, ctx context.Context) error {
+	q := "SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL)"
+	found := false
+	err := as.DB.QueryRowContext(ctx, q, sessionId, userId).Scan(&found)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_session_repo", err)
+		return errors.New("failed to revoke session, please try again")
+	}
+	if !found {
+		return errors.New("session not found")
+	}
+	return as.RevokeRefreshTokenFamily(sessionId, ctx)
+}
+
+func isDuplicateEntry(err error, index string) bool {
+	var driverErr *mysql.MySQLError
+	return errors.As(err, &driverErr) && driverErr.Number == mysqlerr.ER_DUP_ENTRY &&
+		strings.Contains(driverErr.Message, index)
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	return s[:length]
+}
+
+func (as *AuthRepositoryImpl) FindUserByIdentity(provider string, subject string, ctx context.Context) (*User, error) {
+	q := "SELECT " + userColumns + ` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?)`
+	user, err := scanUser(as.DB.QueryRowContext(ctx, q, provider, subject).Scan)
+	if err != nil {
+		lib.ValidateErrorV2("find_user_by_identity_repo", err)
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+// CreateUserWithIdentity creates an account without a password for somebody
+// signing in through an identity provider for the first time.
+func (as *AuthRepositoryImpl) CreateUserWithIdentity(data *User, identity *OIDCIdentity, ctx context.Context) (*User, error) {
+	tx, err := as.DB.BeginTx(ctx, nil)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_with_identity_repo", err)
+		return nil, errors.New("failed to create account, please try again")
+	}
+	defer tx.Rollback()
+
+	var email, emailVerifiedAt any
+	if data.Email != "" {
+		email = data.Email
+		if data.EmailVerified {
+			emailVerifiedAt = time.Now()
+		}
+	}
+	q := "INSERT INTO users (username, email, email_verified_at, password, role) VALUES (?,?,?,?,?)"
+	r, err := tx.ExecContext(ctx, q, data.Username, email, emailVerifiedAt, "", data.Role)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_with_identity_repo", err)
+		if isDuplicateEntry(err, "idx_users_email") {
+			return nil, ErrEmailTaken
+		}
+		// username is the only other unique column
+		if isDuplicateEntry(err, "") {
+			return nil, ErrUsernameTaken
+		}
+		return nil, errors.New("failed to create account, please try again")
+	}
+	data.Id, _ = r.LastInsertId()
+
+	q = "INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?,?,?,?)"
+	_, err = tx.ExecContext(ctx, q, data.Id, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		lib.ValidateErrorV2("create_user_with_identity_repo", err)
+		return nil, errors.New("failed to create account, please try again")
+	}
+
+	if err = tx.Commit(); err != nil {
+		lib.ValidateErrorV2("create_user_with_identity_repo", err)
+		return nil, errors.New("failed to create account, please try again")
+	}
+	data.CreatedAt = time.Now()
+	return data, nil
+}
+
+func (as *AuthRepositoryImpl) LinkIdentity(userId int64, identity *OIDCIdentity, ctx context.Context) error {
+	q := "INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?,?,?,?)"
+	_, err := as.DB.ExecContext(ctx, q, userId, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		lib.ValidateErrorV2("link_identity_repo", err)
+		if isDuplicateEntry(err, "idx_user_identities_provider_subject") {
+			return errors.New("this " + identity.Provider + " account is already linked to a user")
+		}
+		return errors.New("failed to link account, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) SavePersonalAccessToken(data *PersonalAccessToken, ctx context.Context) error {
+	q := `INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES (?,?,?,?,?,?)`
+	r, err := as.DB.ExecContext(
+		ctx, q, data.UserId, data.Name, data.TokenHash, strings.Join(data.Scopes, " "), data.CreatedAt, data.ExpiresAt,
+	)
+	if err != nil {
+		lib.ValidateErrorV2("save_personal_access_token_repo", err)
+		return errors.New("failed to create token, please try again")
+	}
+	data.Id, _ = r.LastInsertId()
+	return nil
+}
+
+const personalAccessTokenColumns = "id, user_id, name, token_hash, scopes, created_at, expires_at, last_used_at"
+
+func scanPersonalAccessToken(scan func(dest ...any) error) (*PersonalAccessToken, error) {
+	token := &PersonalAccessToken{}
+	scopes := ""
+	lastUsedAt := sql.NullTime{}
+	err := scan(
+		&token.Id, &token.UserId, &token.Name, &token.TokenHash, &scopes,
+		&token.CreatedAt, &token.ExpiresAt, &lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, nil
+}
+
+func (as *AuthRepositoryImpl) FindPersonalAccessTokensByUserId(userId int64, ctx context.Context) ([]PersonalAccessToken, error) {
+	q := "SELECT " + personalAccessTokenColumns + ` FROM personal_access_tokens
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY created_at DESC`
+	r, err := as.DB.QueryContext(ctx, q, userId, time.Now())
+	if err != nil {
+		lib.ValidateErrorV2("find_personal_access_tokens_by_user_id_repo", err)
+		return nil, errors.New("failed to get tokens, please try again")
+	}
+	defer r.Close()
+
+	tokens := []PersonalAccessToken{}
+	for r.Next() {
+		token, err := scanPersonalAccessToken(r.Scan)
+		if err != nil {
+			lib.ValidateErrorV2("find_personal_access_tokens_by_user_id_repo", err)
+			return nil, errors.New("failed to get tokens, please try again")
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, nil
+}
+
+// FindPersonalAccessTokenByHash only finds tokens that are neither revoked
+// nor expired.
+func (as *AuthRepositoryImpl) FindPersonalAccessTokenByHash(tokenHash string, ctx context.Context) (*PersonalAccessToken, error) {
+	q := "SELECT " + personalAccessTokenColumns + ` FROM personal_access_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?`
+	token, err := scanPersonalAccessToken(as.DB.QueryRowContext(ctx, q, tokenHash, time.Now()).Scan)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			lib.ValidateErrorV2("find_personal_access_token_by_hash_repo", err)
+		}
+		return nil, errors.New("token is invalid or has expired")
+	}
+	return token, nil
+}
+
+// TouchPersonalAccessToken records when the token was last used, at most
+// once a minute so busy pipelines do not write on every request.
+func (as *AuthRepositoryImpl) TouchPersonalAccessToken(id int64, ctx context.Context) error {
+	now := time.Now()
+	q := "UPDATE personal_access_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)"
+	_, err := as.DB.ExecContext(ctx, q, now, id, now.Add(-time.Minute))
+	if err != nil {
+		lib.ValidateErrorV2("touch_personal_access_token_repo", err)
+		return errors.New("failed to update token, please try again")
+	}
+	return nil
+}
+
+// RevokePersonalAccessToken only revokes tokens that belong to userId.
+func (as *AuthRepositoryImpl) RevokePersonalAccessToken(userId int64, id int64, ctx context.Context) error {
+	q := "UPDATE personal_access_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL"
+	r, err := as.DB.ExecContext(ctx, q, time.Now(), id, userId)
+	if err != nil {
+		lib.ValidateErrorV2("revoke_personal_access_token_repo", err)
+		return errors.New("failed to revoke token, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("token not found")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) ScheduleUserDeletion(data *ScheduledDeletion, ctx context.Context) error {
+	q := "UPDATE users SET deletion_scheduled_at = ?, deletion_articles = ? WHERE id = ? AND placeholder = FALSE"
+	_, err := as.DB.ExecContext(ctx, q, data.ScheduledAt, data.Articles, data.UserId)
+	if err != nil {
+		lib.ValidateErrorV2("schedule_user_deletion_repo", err)
+		return errors.New("failed to delete account, please try again")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) CancelUserDeletion(userId int64, ctx context.Context) error {
+	q := "UPDATE users SET deletion_scheduled_at = NULL, deletion_articles = NULL WHERE id = ? AND deletion_scheduled_at IS NOT NULL"
+	r, err := as.DB.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("cancel_user_deletion_repo", err)
+		return errors.New("failed to cancel account deletion, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("account is not scheduled for deletion")
+	}
+	return nil
+}
+
+// FindScheduledDeletions returns the deletions whose grace period ended
+// before the given time.
+func (as *AuthRepositoryImpl) FindScheduledDeletions(before time.Time, ctx context.Context) ([]ScheduledDeletion, error) {
+	q := `SELECT id, deletion_articles, deletion_scheduled_at FROM users
+		WHERE deletion_scheduled_at <= ? ORDER BY deletion_scheduled_at`
+	r, err := as.DB.QueryContext(ctx, q, before)
+	if err != nil {
+		lib.ValidateErrorV2("find_scheduled_deletions_repo", err)
+		return nil, errors.New("failed to get scheduled deletions")
+	}
+	defer r.Close()
+
+	deletions := []ScheduledDeletion{}
+	for r.Next() {
+		deletion := ScheduledDeletion{}
+		err = r.Scan(&deletion.UserId, &deletion.Articles, &deletion.ScheduledAt)
+		if err != nil {
+			lib.ValidateErrorV2("find_scheduled_deletions_repo", err)
+			return nil, errors.New("failed to get scheduled deletions")
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, nil
+}
+
+func (as *AuthRepositoryImpl) FindPlaceholderUserId(tx *sql.Tx, ctx context.Context) (int64, error) {
+	q := "SELECT id FROM users WHERE placeholder = TRUE ORDER BY id LIMIT 1"
+	var id int64
+	err := tx.QueryRowContext(ctx, q).Scan(&id)
+	if err != nil {
+		lib.ValidateErrorV2("find_placeholder_user_id_repo", err)
+		return 0, errors.New("placeholder author is missing")
+	}
+	return id, nil
+}
+
+// LockScheduledDeletion locks the user row for the rest of tx, a
+// cancellation that comes in meanwhile waits for it. It fails with
+// ErrDeletionCancelled when the deletion was cancelled already.
+func (as *AuthRepositoryImpl) LockScheduledDeletion(tx *sql.Tx, userId int64, ctx context.Context) error {
+	q := "SELECT id FROM users WHERE id = ? AND deletion_scheduled_at <= ? AND placeholder = FALSE FOR UPDATE"
+	var id int64
+	err := tx.QueryRowContext(ctx, q, userId, time.Now()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDeletionCancelled
+	}
+	if err != nil {
+		lib.ValidateErrorV2("lock_scheduled_deletion_repo", err)
+		return errors.New("failed to delete account")
+	}
+	return nil
+}
+
+// DeleteUser removes the user and everything the auth package stores about
+// them as part of tx, the user must have been locked with
+// LockScheduledDeletion and their articles handled first.
+func (as *AuthRepositoryImpl) DeleteUser(tx *sql.Tx, userId int64, ctx context.Context) error {
+	q := "DELETE FROM users WHERE id = ? AND deletion_scheduled_at <= ? AND placeholder = FALSE"
+	r, err := tx.ExecContext(ctx, q, userId, time.Now())
+	if err != nil {
+		lib.ValidateErrorV2("delete_user_repo", err)
+		return errors.New("failed to delete account")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return ErrDeletionCancelled
+	}
+
+	tables := []string{
+		"refresh_tokens", "sessions", "revoked_access_tokens", "user_tokens",
+		"totp_recovery_codes", "user_identities", "personal_access_tokens",
+	}
+	for _, table := range tables {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", userId)
+		if err != nil {
+			lib.ValidateErrorV2("delete_user_repo", err)
+			return errors.New("failed to delete account")
+		}
+	}
+	return nil
+}
+
+// FindUsers returns one page of the users matching data and how many match
+// in total. Placeholder accounts are left out.
+func (as *AuthRepositoryImpl) FindUsers(data *UserListRequest, ctx context.Context) ([]User, int, error) {
+	where := " WHERE placeholder = FALSE"
+	args := []any{}
+	if data.Query != "" {
+		pattern := "%" + likeEscaper.Replace(data.Query) + "%"
+		where += " AND (username LIKE ? OR email LIKE ? OR display_name LIKE ?)"
+		args = append(args, pattern, pattern, pattern)
+	}
+	if data.Role != "" {
+		where += " AND role = ?"
+		args = append(args, data.Role)
+	}
+	switch data.Status {
+	case USER_STATUS_ACTIVE:
+		where += " AND suspended_at IS NULL"
+	case USER_STATUS_SUSPENDED:
+		where += " AND suspended_at IS NOT NULL"
+	}
+
+	total := 0
+	err := as.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users"+where, args...).Scan(&total)
+	if err != nil {
+		lib.ValidateErrorV2("find_users_repo", err)
+		return nil, 0, errors.New("failed to get users, please try again")
+	}
+
+	q := "SELECT " + userColumns + " FROM users" + where + " ORDER BY id LIMIT ? OFFSET ?"
+	r, err := as.DB.QueryContext(ctx, q, append(args, data.PerPage, (data.Page-1)*data.PerPage)...)
+	if err != nil {
+		lib.ValidateErrorV2("find_users_repo", err)
+		return nil, 0, errors.New("failed to get users, please try again")
+	}
+	defer r.Close()
+
+	users := []User{}
+	for r.Next() {
+		user, err := scanUser(r.Scan)
+		if err != nil {
+			lib.ValidateErrorV2("find_users_repo", err)
+			return nil, 0, errors.New("failed to get users, please try again")
+		}
+		users = append(users, *user)
+	}
+	return users, total, nil
+}
+
+// likeEscaper makes user input match literally inside a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (as *AuthRepositoryImpl) SuspendUser(userId int64, reason string, suspendedBy int64, ctx context.Context) error {
+	q := `UPDATE users SET suspended_at = ?, suspension_reason = ?, suspended_by = ?
+		WHERE id = ? AND placeholder = FALSE`
+	r, err := as.DB.ExecContext(ctx, q, time.Now(), reason, suspendedBy, userId)
+	if err != nil {
+		lib.ValidateErrorV2("suspend_user_repo", err)
+		return errors.New("failed to suspend user, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) UnsuspendUser(userId int64, ctx context.Context) error {
+	q := "UPDATE users SET suspended_at = NULL, suspension_reason = '', suspended_by = NULL WHERE id = ? AND suspended_at IS NOT NULL"
+	r, err := as.DB.ExecContext(ctx, q, userId)
+	if err != nil {
+		lib.ValidateErrorV2("unsuspend_user_repo", err)
+		return errors.New("failed to unsuspend user, please try again")
+	}
+	if affected, _ := r.RowsAffected(); affected < 1 {
+		return errors.New("user not found or not suspended")
+	}
+	return nil
+}
+
+func (as *AuthRepositoryImpl) SaveAuditEvent(data *AuditEvent, ctx context.Context) error {
+	q := `INSERT INTO audit_events (event, outcome, user_id, actor_id, username, ip_address, user_agent, detail, created_at)
+		VALUES (?,?,?,?,?,?,?,?,?)`
+	r, err := as.DB.ExecContext(
+		ctx, q, data.Event, data.Outcome, nullableId(data.UserId), nullableId(data.ActorId), truncate(data.Username, 255),
+		data.IpAddress, truncate(data.UserAgent, 512), truncate(data.Detail, 255), data.CreatedAt,
+	)
+	if err != nil {
+		lib.ValidateErrorV2("save_audit_event_repo", err)
+		return errors.New("failed to save audit event")
+	}
+	data.Id, _ = r.LastInsertId()
+	return nil
+}
+
+const auditEventColumns = `id, event, outcome, COALESCE(user_id, 0), COALESCE(actor_id, 0), username,
+	ip_address, user_agent, detail, created_at`
+
+func scanAuditEvent(scan func(dest ...any) error) (*AuditEvent, error) {
+	event := &AuditEvent{}
+	err := scan(
+		&event.Id, &event.Event, &event.Outcome, &event.UserId, &event.ActorId, &event.Username,
+		&event.IpAddress, &event.UserAgent, &event.Detail, &event.CreatedAt,
+	)
+	return event, err
+}
+
+func auditEventWhere(data *AuditEventFilter) (string, []any) {
+	where := " WHERE 1 = 1"
+	args := []any{}
+	if data.Event != "" {
+		where += " AND event = ?"
+		args = append(args, data.Event)
+	}
+	if data.UserId != 0 {
+		where += " AND (user_id = ? OR actor_id = ?)"
+		args = append(args, data.UserId, data.UserId)
+	}
+	if data.Outcome != "" {
+		where += " AND outcome = ?"
+		args = append(args, data.Outcome)
+	}
+	if !data.From.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, data.From)
+	}
+	if !data.To.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, data.To)
+	}
+	return where, args
+}
+
+// FindAuditEvents returns one page of the matching events, newest first,
+// and how many match in total.
+func (as *AuthRepositoryImpl) FindAuditEvents(data *AuditEventFilter, ctx context.Context) ([]AuditEvent, int, error) {
+	where, args := auditEventWhere(data)
+	total := 0
+	err := as.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&total)
+	if err != nil {
+		lib.ValidateErrorV2("find_audit_events_repo", err)
+		return nil, 0, errors.New("failed to get audit events, please try again")
+	}
+
+	q := "SELECT " + auditEventColumns + " FROM audit_events" + where + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	r, err := as.DB.QueryContext(ctx, q, append(args, data.PerPage, (data.Page-1)*data.PerPage)...)
+	if err != nil {
+		lib.ValidateErrorV2("find_audit_events_repo", err)
+		return nil, 0, errors.New("failed to get audit events, please try again")
+	}
+	defer r.Close()
+
+	events := []AuditEvent{}
+	for r.Next() {
+		event, err := scanAuditEvent(r.Scan)
+		if err != nil {
+			lib.ValidateErrorV2("find_audit_events_repo", err)
+			return nil, 0, errors.New("failed to get audit events, please try again")
+		}
+		events = append(events, *event)
+	}
+	return events, total, nil
+}
+
+// ExportAuditEvents calls fn with every matching event, oldest first,
+// without holding them all in memory. It stops at the first error of fn.
+func (as *AuthRepositoryImpl) ExportAuditEvents(
+	data *AuditEventFilter, fn func(*AuditEvent) error, ctx context.Context,
+) error {
+	where, args := auditEventWhere(data)
+	q := "SELECT " + auditEventColumns + " FROM audit_events" + where + " ORDER BY id"
+	r, err := as.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		lib.ValidateErrorV2("export_audit_events_repo", err)
+		return errors.New("failed to export audit events, please try again")
+	}
+	defer r.Close()
+
+	for r.Next() {
+		event, err := scanAuditEvent(r.Scan)
+		if err != nil {
+			lib.ValidateErrorV2("export_audit_events_repo", err)
+			return errors.New("failed to export audit events")
+		}
+		if err = fn(event); err != nil {
+			return err
+		}
+	}
+	if err = r.Err(); err != nil {
+		lib.ValidateErrorV2("export_audit_events_repo", err)
+		return errors.New("failed to export audit events")
+	}
+	return nil
+}
+
+// nullableId stores ids that are not known as NULL
+func nullableId(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
@@ -0,0 +1,47 @@
+package auth
+
+const (
+	ROLE_READER = "reader"
+	ROLE_AUTHOR = "author"
+	ROLE_EDITOR = "editor"
+	ROLE_ADMIN  = "admin"
+)
+
+const (
+	// PERMISSION_WRITE_ARTICLES allows creating articles and changing the ones
+	// the user wrote
+	PERMISSION_WRITE_ARTICLES = "articles:write"
+	// PERMISSION_MODERATE_ARTICLES allows changing and deleting articles
+	// written by anybody
+	PERMISSION_MODERATE_ARTICLES = "articles:moderate"
+	PERMISSION_WRITE_FILES       = "files:write"
+	PERMISSION_MANAGE_USERS      = "users:manage"
+)
+
+var rolePermissions = map[string][]string{
+	ROLE_READER: {},
+	ROLE_AUTHOR: {
+		PERMISSION_WRITE_ARTICLES,
+		PERMISSION_WRITE_FILES,
+	},
+	ROLE_EDITOR: {
+		PERMISSION_WRITE_ARTICLES,
+		PERMISSION_MODERATE_ARTICLES,
+		PERMISSION_WRITE_FILES,
+	},
+	ROLE_ADMIN: {
+		PERMISSION_WRITE_ARTICLES,
+		PERMISSION_MODERATE_ARTICLES,
+		PERMISSION_WRITE_FILES,
+		PERMISSION_MANAGE_USERS,
+	},
+}
+
+func HasPermission(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -5,51 +5,139 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"io"
+	"math"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/zulfikarrosadi/go-blog-api/lib"
 	"github.com/zulfikarrosadi/go-blog-api/web"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const FIFTEEN_DAY_IN_HOUR = 360
-const BCRYPT_COST = 10
 
 type AuthService interface {
 	SignIn(*UserSignInRequest, context.Context) (*AccessToken, *RefreshToken, *web.Response)
 	SignUp(*UserSignUpRequest, context.Context) (*AccessToken, *RefreshToken, *web.Response)
+	RefreshToken(string, context.Context) (*AccessToken, *RefreshToken, *web.Response)
+	SignOut(*AccessToken, bool, context.Context) *web.Response
+	UpdateUserRole(*AccessToken, *UpdateUserRoleRequest, context.Context) *web.Response
+	RequestPasswordReset(*PasswordResetRequest, context.Context) *web.Response
+	ResetPassword(*PasswordResetConfirmRequest, context.Context) *web.Response
+	VerifyEmail(*EmailVerificationRequest, context.Context) *web.Response
+	ResendEmailVerification(*AccessToken, context.Context) *web.Response
+	ChangeEmail(*AccessToken, *ChangeEmailRequest, context.Context) *web.Response
+	EnrollTotp(*AccessToken, context.Context) *web.Response
+	ConfirmTotp(*AccessToken, *TotpCodeRequest, context.Context) *web.Response
+	DisableTotp(*AccessToken, *TotpCodeRequest, context.Context) *web.Response
+	SignInTwoFactor(*TwoFactorSignInRequest, context.Context) (*AccessToken, *RefreshToken, *web.Response)
+	GetSessions(*AccessToken, context.Context) *web.Response
+	RevokeSession(*AccessToken, *SessionRequest, context.Context) *web.Response
+	StartOIDCSignIn(string, int64, context.Context) (string, string, *web.Response)
+	FinishOIDCSignIn(string, string, string, string, context.Context) (*AccessToken, *RefreshToken, *web.Response)
+	CreatePersonalAccessToken(*AccessToken, *CreatePersonalAccessTokenRequest, context.Context) *web.Response
+	GetPersonalAccessTokens(*AccessToken, context.Context) *web.Response
+	RevokePersonalAccessToken(*AccessToken, *PersonalAccessTokenRequest, context.Context) *web.Response
+	GetCurrentUser(*AccessToken, context.Context) *web.Response
+	UpdateProfile(*AccessToken, *UpdateProfileRequest, context.Context) *web.Response
+	ChangePassword(*AccessToken, *ChangePasswordRequest, context.Context) *web.Response
+	ScheduleAccountDeletion(*AccessToken, *DeleteAccountRequest, context.Context) *web.Response
+	CancelAccountDeletion(*AccessToken, context.Context) *web.Response
+	GetUsers(*UserListRequest, context.Context) *web.Response
+	GetUser(*UserRequest, context.Context) *web.Response
+	SuspendUser(*AccessToken, *SuspendUserRequest, context.Context) *web.Response
+	UnsuspendUser(*AccessToken, *UserRequest, context.Context) *web.Response
+	SignOutUser(*AccessToken, *UserRequest, context.Context) *web.Response
+	RequestMagicLink(*MagicLinkRequest, context.Context) *web.Response
+	SignInWithMagicLink(*MagicLinkSignInRequest, context.Context) (*AccessToken, *RefreshToken, *web.Response)
+	ImpersonateUser(*AccessToken, *ImpersonateUserRequest, context.Context) *web.Response
+	IntrospectToken(*IntrospectionRequest, context.Context) (*IntrospectionResponse, *web.Response)
+	GetAuditEvents(*AuditEventListRequest, context.Context) *web.Response
+	ExportAuditEvents(*AuditEventListRequest, io.Writer, context.Context) *web.Response
 }
 
 type AuthServiceImpl struct {
 	AuthRepository
-	v *validator.Validate
+	v             *validator.Validate
+	keyRing       *KeyRing
+	mailer        lib.Mailer
+	config        Config
+	loginThrottle *LoginThrottle
+	oidcProviders map[string]*OIDCProvider
+	// dummyPasswordHash is verified against when the username does not
+	// exist so the sign in takes as long as it does for a wrong password
+	dummyPasswordHash string
 }
 
 type AccessToken struct {
 	AccessTokenId string `json:"accessTokenId"`
+	SessionId     string `json:"sessionId"`
 	UserId        int64  `json:"id"`
 	Username      string `json:"username"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"emailVerified"`
+	// Actor is the admin behind an impersonation token, the other claims
+	// are those of the impersonated user
+	Actor *Actor `json:"act,omitempty"`
+	// PersonalAccessTokenId and Scopes are only set when the request was
+	// made with a personal access token, they are never part of a jwt
+	PersonalAccessTokenId int64    `json:"-"`
+	Scopes                []string `json:"-"`
 	jwt.RegisteredClaims
 }
 
+type Actor struct {
+	UserId   int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// HasPermission is HasPermission of the role, narrowed down to the scopes
+// of the personal access token the request was made with.
+func (at *AccessToken) HasPermission(permission string) bool {
+	if at.PersonalAccessTokenId != 0 && !slices.Contains(at.Scopes, permission) {
+		return false
+	}
+	return HasPermission(at.Role, permission)
+}
+
 type RefreshToken struct {
 	RefreshTokenId string `json:"refreshTokenId"`
+	FamilyId       string `json:"familyId"`
 	Id             int64  `json:"id"`
 	Username       string `json:"username"`
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(authRepository AuthRepository, v *validator.Validate) *AuthServiceImpl {
+func NewAuthService(
+	authRepository AuthRepository,
+	v *validator.Validate,
+	keyRing *KeyRing,
+	mailer lib.Mailer,
+	config Config,
+) *AuthServiceImpl {
+	dummyPasswordHash, _ := config.PasswordHasher.Hash("dummy password")
 	return &AuthServiceImpl{
-		AuthRepository: authRepository,
-		v:              v,
+		AuthRepository:    authRepository,
+		v:                 v,
+		keyRing:           keyRing,
+		mailer:            mailer,
+		config:            config,
+		loginThrottle:     NewLoginThrottle(config.LoginBaseLockout, config.LoginMaxLockout),
+		oidcProviders:     config.OIDCProviders,
+		dummyPasswordHash: dummyPasswordHash,
 	}
 }
 
-func (asi *AuthServiceImpl) SignIn(data *UserSignInRequest, ctx context.Context) (*AccessToken, *RefreshToken, *web.Response) {
+func (asi *AuthServiceImpl) SignIn(
+	data *UserSignInRequest, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_IN, Username: data.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
 	err := asi.v.Struct(data)
 	if err != nil {
 		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
@@ -63,60 +151,193 @@ func (asi *AuthServiceImpl) SignIn(data *UserSignInRequest, ctx context.Context)
 		}
 	}
 
+	userKey := "username:" + strings.ToLower(data.Username)
+	ipKey := "ip:" + clientInfoFromContext(ctx).IpAddress
+	retryAfter := max(asi.loginThrottle.RetryAfter(userKey), asi.loginThrottle.RetryAfter(ipKey))
+	if retryAfter > 0 {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusTooManyRequests,
+			Error: web.Error{
+				Message: "too many failed sign in attempts, please try again later",
+				Detail:  RetryAfterDetail{RetryAfter: int(math.Ceil(retryAfter.Seconds()))},
+			},
+		}
+	}
+
+	// unknown usernames and wrong passwords must look the same from the
+	// outside, both in the response and in how long it takes
+	invalidCredentials := &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusBadRequest,
+		Error: web.Error{
+			Message: "username or password is incorrect",
+		},
+	}
 	user, err := asi.AuthRepository.FindUserByUsername(data, ctx)
 	if err != nil {
-		response := &web.Response{
-			Status: web.STATUS_FAIL,
+		asi.config.PasswordHasher.Verify(asi.dummyPasswordHash, data.Password)
+		asi.loginThrottle.Failure(userKey, asi.config.LoginMaxAttempts)
+		asi.loginThrottle.Failure(ipKey, asi.config.LoginMaxAttemptsPerIp)
+		return nil, nil, invalidCredentials
+	}
+	event.UserId = user.Id
+
+	if !asi.config.PasswordHasher.Verify(user.Password, data.Password) {
+		asi.loginThrottle.Failure(userKey, asi.config.LoginMaxAttempts)
+		asi.loginThrottle.Failure(ipKey, asi.config.LoginMaxAttemptsPerIp)
+		return nil, nil, invalidCredentials
+	}
+	asi.loginThrottle.Reset(userKey)
+	asi.rehashPassword(user, data.Password, ctx)
+
+	if user.TotpEnabled {
+		event.Detail = "two factor required"
+		return nil, nil, asi.newTwoFactorChallenge(user, ctx)
+	}
+	return asi.issueTokens(user, "", ctx)
+}
+
+func (asi *AuthServiceImpl) SignUp(
+	data *UserSignUpRequest, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_UP, Username: data.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	err := asi.v.Struct(data)
+	if err != nil {
+		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
+		return nil, nil, &web.Response{
+			Status: "fail",
 			Code:   http.StatusBadRequest,
 			Error: web.Error{
-				Message: err.Error(),
+				Message: "validation error",
+				Detail:  validatedError,
 			},
 		}
-		return nil, nil, response
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(data.Password))
+	if errorResponse := asi.validatePassword("password", data.Password); errorResponse != nil {
+		return nil, nil, errorResponse
+	}
+
+	hashedPassword, err := asi.config.PasswordHasher.Hash(data.Password)
 	if err != nil {
-		response := &web.Response{
+		return nil, nil, failedToHashPassword(err)
+	}
+	data.Password = hashedPassword
+	user, err := asi.AuthRepository.CreateUser(data, ctx)
+	if err != nil {
+		return nil, nil, &web.Response{
 			Status: web.STATUS_FAIL,
 			Code:   http.StatusBadRequest,
 			Error: web.Error{
 				Message: err.Error(),
 			},
 		}
-		return nil, nil, response
 	}
+	event.UserId = user.UserId
+	newUser := &User{
+		Id:       user.UserId,
+		Username: user.Username,
+		Email:    user.Email,
+		Role:     user.Role,
+	}
+	asi.sendEmailVerification(newUser, ctx)
+	return asi.issueTokens(newUser, "", ctx)
+}
 
-	accessTokenId := make([]byte, 10)
-	refreshTokenId := make([]byte, 10)
-	rand.Read(accessTokenId)
-	rand.Read(refreshTokenId)
+func (asi *AuthServiceImpl) RefreshToken(
+	token string, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_TOKEN_REFRESH}
+	defer func() { asi.audit(event, response, ctx) }()
 
-	accessTokenClaims := &AccessToken{
-		AccessTokenId: base64.URLEncoding.EncodeToString(accessTokenId)[:10],
-		UserId:        user.Id,
-		Username:      user.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 15)),
+	unauthorized := &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusUnauthorized,
+		Error: web.Error{
+			Message: "refresh token invalid",
 		},
 	}
-	refreshTokenClaims := &RefreshToken{
-		RefreshTokenId: base64.URLEncoding.EncodeToString(refreshTokenId)[:10],
-		Id:             user.Id,
-		Username:       user.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * FIFTEEN_DAY_IN_HOUR)),
-		},
+
+	_, presentedToken, err := asi.keyRing.ValidateToken(token, true)
+	if err != nil {
+		return nil, nil, unauthorized
 	}
-	return accessTokenClaims, refreshTokenClaims, nil
+	event.UserId = presentedToken.Id
+	event.Username = presentedToken.Username
+
+	storedToken, err := asi.AuthRepository.FindRefreshTokenById(presentedToken.RefreshTokenId, ctx)
+	if err != nil || storedToken.UserId != presentedToken.Id || storedToken.RevokedAt.Valid {
+		return nil, nil, unauthorized
+	}
+
+	// a refresh token that was already exchanged is being presented again,
+	// either the legitimate client or an attacker holds a stolen copy, so
+	// every token descending from the same sign in is revoked
+	if storedToken.UsedAt.Valid {
+		asi.revokeReusedFamily(storedToken)
+		event.Detail = "refresh token reused, session revoked"
+		return nil, nil, unauthorized
+	}
+	err = asi.AuthRepository.MarkRefreshTokenUsed(storedToken.Id, ctx)
+	if err != nil {
+		asi.revokeReusedFamily(storedToken)
+		return nil, nil, unauthorized
+	}
+
+	// read the user again instead of trusting the refresh token claims so
+	// role changes are picked up on the next refresh
+	user, err := asi.AuthRepository.FindUserById(storedToken.UserId, ctx)
+	if err != nil {
+		return nil, nil, unauthorized
+	}
+	return asi.issueTokens(user, storedToken.FamilyId, ctx)
 }
 
-func (asi *AuthServiceImpl) SignUp(data *UserSignUpRequest, ctx context.Context) (*AccessToken, *RefreshToken, *web.Response) {
+// SignOut revokes the refresh token family behind the access token and puts
+// the access token on the denylist. When everywhere is true every session of
+// the user is revoked instead.
+func (asi *AuthServiceImpl) SignOut(accessToken *AccessToken, everywhere bool, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_OUT, UserId: accessToken.UserId, Username: accessToken.Username}
+	if everywhere {
+		event.Event = AUDIT_SIGN_OUT_EVERYWHERE
+	}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	var err error
+	if everywhere {
+		err = asi.AuthRepository.RevokeUserTokens(accessToken.UserId, ctx)
+	} else {
+		err = asi.AuthRepository.RevokeRefreshTokenFamily(accessToken.SessionId, ctx)
+	}
+	if err == nil {
+		err = asi.AuthRepository.RevokeAccessToken(accessToken, ctx)
+	}
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+func (asi *AuthServiceImpl) UpdateUserRole(
+	accessToken *AccessToken, data *UpdateUserRoleRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_ROLE_CHANGE, UserId: data.UserId, ActorId: accessToken.UserId, Detail: data.Role}
+	defer func() { asi.audit(event, response, ctx) }()
+
 	err := asi.v.Struct(data)
 	if err != nil {
 		validatedError := lib.ValidateError(err.(validator.ValidationErrors))
-		return nil, nil, &web.Response{
-			Status: "fail",
+		return &web.Response{
+			Status: web.STATUS_FAIL,
 			Code:   http.StatusBadRequest,
 			Error: web.Error{
 				Message: "validation error",
@@ -125,73 +346,226 @@ func (asi *AuthServiceImpl) SignUp(data *UserSignUpRequest, ctx context.Context)
 		}
 	}
 
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(data.Password), BCRYPT_COST)
-	data.Password = string(hashedPassword)
-	user, err := asi.AuthRepository.CreateUser(data, ctx)
+	err = asi.AuthRepository.UpdateUserRole(data, ctx)
 	if err != nil {
-		response := &web.Response{
+		return &web.Response{
 			Status: web.STATUS_FAIL,
-			Code:   http.StatusBadRequest,
+			Code:   http.StatusNotFound,
 			Error: web.Error{
 				Message: err.Error(),
 			},
 		}
-		return nil, nil, response
 	}
-	accessTokenId := make([]byte, 10)
-	refreshTokenId := make([]byte, 10)
-	rand.Read(accessTokenId)
-	rand.Read(refreshTokenId)
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: UserAuthResponse{
+			UserId: data.UserId,
+			Role:   data.Role,
+		},
+	}
+}
+
+func (asi *AuthServiceImpl) revokeReusedFamily(storedToken *StoredRefreshToken) {
+	lib.ErrorLog(
+		"refresh_token_service",
+		"refresh token reuse detected, revoking token family",
+		errors.New("refresh token "+storedToken.Id+" of family "+storedToken.FamilyId+" reused"),
+	)
+	// the request context may already be cancelled by the time reuse is
+	// detected, the family must be revoked regardless
+	asi.AuthRepository.RevokeRefreshTokenFamily(storedToken.FamilyId, context.Background())
+}
+
+// issueTokens creates a new access and refresh token pair and persists the
+// refresh token so it can later be rotated or revoked. familyId ties every
+// refresh token issued from a single sign in together, an empty familyId
+// starts a new session.
+func (asi *AuthServiceImpl) issueTokens(
+	user *User, familyId string, ctx context.Context,
+) (*AccessToken, *RefreshToken, *web.Response) {
+	// every sign in and refresh ends up here
+	if user.SuspendedAt != nil {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusForbidden,
+			Error: web.Error{
+				Message: "your account has been suspended: " + user.SuspensionReason,
+			},
+		}
+	}
+
+	isNewSession := familyId == ""
+	if isNewSession {
+		familyId = newTokenId()
+	}
 
 	accessTokenClaims := &AccessToken{
-		AccessTokenId: base64.URLEncoding.EncodeToString(accessTokenId)[:10],
-		UserId:        user.UserId,
+		AccessTokenId: newTokenId(),
+		SessionId:     familyId,
+		UserId:        user.Id,
 		Username:      user.Username,
+		Role:          user.Role,
+		EmailVerified: user.EmailVerified,
 		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 15)),
 		},
 	}
 	refreshTokenClaims := &RefreshToken{
-		RefreshTokenId: base64.URLEncoding.EncodeToString(refreshTokenId)[:10],
-		Id:             user.UserId,
+		RefreshTokenId: newTokenId(),
+		FamilyId:       familyId,
+		Id:             user.Id,
 		Username:       user.Username,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * FIFTEEN_DAY_IN_HOUR)),
 		},
 	}
+
+	clientInfo := clientInfoFromContext(ctx)
+	session := &Session{
+		Id:         familyId,
+		UserId:     user.Id,
+		UserAgent:  clientInfo.UserAgent,
+		IpAddress:  clientInfo.IpAddress,
+		CreatedAt:  time.Now(),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  refreshTokenClaims.ExpiresAt.Time,
+	}
+	if isNewSession {
+		err := asi.AuthRepository.SaveSession(session, ctx)
+		if err != nil {
+			return nil, nil, &web.Response{
+				Status: web.STATUS_FAIL,
+				Code:   http.StatusInternalServerError,
+				Error: web.Error{
+					Message: err.Error(),
+				},
+			}
+		}
+	} else {
+		err := asi.AuthRepository.TouchSession(session, ctx)
+		if err != nil {
+			return nil, nil, &web.Response{
+				Status: web.STATUS_FAIL,
+				Code:   http.StatusUnauthorized,
+				Error: web.Error{
+					Message: err.Error(),
+				},
+			}
+		}
+	}
+
+	err := asi.AuthRepository.SaveRefreshToken(refreshTokenClaims, ctx)
+	if err != nil {
+		return nil, nil, &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
 	return accessTokenClaims, refreshTokenClaims, nil
 }
 
-func CreateToken(newRefreshToken bool, claims ...jwt.Claims) []string {
-	accessTokenClaims := jwt.NewWithClaims(jwt.SigningMethodHS256, claims[0])
-	accessTokenString, _ := accessTokenClaims.SignedString([]byte("temp key"))
+// rehashPassword moves the stored hash of user to the current algorithm and
+// parameters, it can only be done while the plain password is known. The
+// sign in goes on when it fails, the next one tries again.
+func (asi *AuthServiceImpl) rehashPassword(user *User, password string, ctx context.Context) {
+	if !asi.config.PasswordHasher.NeedsRehash(user.Password) {
+		return
+	}
+	hashedPassword, err := asi.config.PasswordHasher.Hash(password)
+	if err == nil {
+		err = asi.AuthRepository.UpdateUserPassword(user.Id, hashedPassword, ctx)
+	}
+	if err != nil {
+		lib.ErrorLog("rehash_password_service", "failed to rehash password", err)
+		return
+	}
+	user.Password = hashedPassword
+}
+
+func failedToHashPassword(err error) *web.Response {
+	lib.ErrorLog("hash_password_service", "failed to hash password", err)
+	return &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusInternalServerError,
+		Error: web.Error{
+			Message: "failed to save password, please try again",
+		},
+	}
+}
+
+func (asi *AuthServiceImpl) validateStruct(data any) *web.Response {
+	err := asi.v.Struct(data)
+	if err == nil {
+		return nil
+	}
+	validatedError := lib.ValidateError(err.(validator.ValidationErrors))
+	return &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusBadRequest,
+		Error: web.Error{
+			Message: "validation error",
+			Detail:  validatedError,
+		},
+	}
+}
+
+// validatePassword applies the password policy, every place that sets a
+// password must go through it.
+func (asi *AuthServiceImpl) validatePassword(path string, password string) *web.Response {
+	validatedError := asi.config.PasswordPolicy.Validate(path, password)
+	if len(validatedError) == 0 {
+		return nil
+	}
+	return &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusBadRequest,
+		Error: web.Error{
+			Message: "validation error",
+			Detail:  validatedError,
+		},
+	}
+}
+
+func clientInfoFromContext(ctx context.Context) ClientInfo {
+	clientInfo, _ := ctx.Value("clientInfo").(ClientInfo)
+	return clientInfo
+}
+
+func newTokenId() string {
+	id := make([]byte, 15)
+	rand.Read(id)
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func (kr *KeyRing) CreateToken(newRefreshToken bool, claims ...jwt.Claims) []string {
+	accessTokenString, _ := kr.Sign(claims[0], JWT_TYPE_ACCESS_TOKEN)
 
 	if !newRefreshToken {
 		return []string{accessTokenString}
 	}
-	refreshTokenClaims := jwt.NewWithClaims(jwt.SigningMethodHS256, claims[1])
-	refreshTokenString, _ := refreshTokenClaims.SignedString([]byte("temp key"))
+	refreshTokenString, _ := kr.Sign(claims[1], JWT_TYPE_REFRESH_TOKEN)
 
 	return []string{accessTokenString, refreshTokenString}
 }
 
-func ValidateToken(token string, isRefreshToken bool) (*AccessToken, *RefreshToken, error) {
+func (kr *KeyRing) ValidateToken(token string, isRefreshToken bool) (*AccessToken, *RefreshToken, error) {
 	if isRefreshToken {
 		refreshToken := &RefreshToken{}
-		_, err := jwt.ParseWithClaims(token, refreshToken, func(t *jwt.Token) (interface{}, error) {
-			return []byte("temp key"), nil
-		})
-		if err != nil {
+		err := kr.Parse(token, refreshToken, JWT_TYPE_REFRESH_TOKEN)
+		if err != nil || refreshToken.RefreshTokenId == "" {
 			return nil, nil, errors.New("refresh token invalid")
 		}
 		return nil, refreshToken, nil
 	}
 
 	accessToken := &AccessToken{}
-	_, err := jwt.ParseWithClaims(token, accessToken, func(t *jwt.Token) (interface{}, error) {
-		return []byte("temp key"), nil
-	})
-	if err != nil {
+	err := kr.Parse(token, accessToken, JWT_TYPE_ACCESS_TOKEN)
+	if err != nil || accessToken.AccessTokenId == "" {
 		return nil, nil, errors.New("access token invalid")
 	}
 	return accessToken, nil, nil
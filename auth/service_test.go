@@ -0,0 +1,556 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zulfikarrosadi/go-blog-api/lib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeAuthRepository knows no users, methods a test does not override panic
+// on the nil AuthRepository.
+type fakeAuthRepository struct {
+	AuthRepository
+}
+
+func (fakeAuthRepository) FindUserByUsername(*UserSignInRequest, context.Context) (*User, error) {
+	return nil, errors.New("username or password is incorrect")
+}
+
+func (fakeAuthRepository) FindUserByLogin(string, context.Context) (*User, error) {
+	return nil, errors.New("user not found")
+}
+
+func (fakeAuthRepository) SaveAuditEvent(*AuditEvent, context.Context) error {
+	return nil
+}
+
+// memoryAuthRepository keeps what the sign in flows write in maps, enough to
+// run them end to end. Like fakeAuthRepository, methods it does not have
+// panic.
+type memoryAuthRepository struct {
+	AuthRepository
+
+	mu            sync.Mutex
+	users         map[int64]*User
+	identities    map[string]int64
+	refreshTokens map[string]*StoredRefreshToken
+	sessions      map[string]*Session
+	revoked       map[string]bool
+	userTokens    map[string]*UserToken
+	usedTokens    map[string]bool
+	totpSteps     map[int64]int64
+	recoveryCodes map[string]bool
+}
+
+func newMemoryAuthRepository(users ...*User) *memoryAuthRepository {
+	repository := &memoryAuthRepository{
+		users:         map[int64]*User{},
+		identities:    map[string]int64{},
+		refreshTokens: map[string]*StoredRefreshToken{},
+		sessions:      map[string]*Session{},
+		revoked:       map[string]bool{},
+		userTokens:    map[string]*UserToken{},
+		usedTokens:    map[string]bool{},
+		totpSteps:     map[int64]int64{},
+		recoveryCodes: map[string]bool{},
+	}
+	for _, user := range users {
+		repository.users[user.Id] = user
+	}
+	return repository
+}
+
+func (mr *memoryAuthRepository) FindUserById(id int64, _ context.Context) (*User, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[id]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (mr *memoryAuthRepository) FindUserByIdentity(provider string, subject string, ctx context.Context) (*User, error) {
+	mr.mu.Lock()
+	userId, ok := mr.identities[provider+" "+subject]
+	mr.mu.Unlock()
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	return mr.FindUserById(userId, ctx)
+}
+
+func (mr *memoryAuthRepository) CreateUserWithIdentity(data *User, identity *OIDCIdentity, _ context.Context) (*User, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, user := range mr.users {
+		if data.Email != "" && strings.EqualFold(user.Email, data.Email) {
+			return nil, ErrEmailTaken
+		}
+		if user.Username == data.Username {
+			return nil, ErrUsernameTaken
+		}
+	}
+	user := *data
+	user.Id = int64(len(mr.users) + 1)
+	mr.users[user.Id] = &user
+	mr.identities[identity.Provider+" "+identity.Subject] = user.Id
+	copied := user
+	return &copied, nil
+}
+
+func (mr *memoryAuthRepository) LinkIdentity(userId int64, identity *OIDCIdentity, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.identities[identity.Provider+" "+identity.Subject]; ok {
+		return errors.New("this " + identity.Provider + " account is already linked to a user")
+	}
+	mr.identities[identity.Provider+" "+identity.Subject] = userId
+	return nil
+}
+
+func (mr *memoryAuthRepository) SaveSession(data *Session, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	session := *data
+	mr.sessions[data.Id] = &session
+	return nil
+}
+
+func (mr *memoryAuthRepository) TouchSession(data *Session, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	session, ok := mr.sessions[data.Id]
+	if !ok || session.UserId != data.UserId || mr.revoked[data.Id] {
+		return errors.New("session has been revoked")
+	}
+	session.LastUsedAt = data.LastUsedAt
+	return nil
+}
+
+func (mr *memoryAuthRepository) SaveRefreshToken(data *RefreshToken, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.refreshTokens[data.RefreshTokenId] = &StoredRefreshToken{
+		Id:        data.RefreshTokenId,
+		FamilyId:  data.FamilyId,
+		UserId:    data.Id,
+		ExpiresAt: data.ExpiresAt.Time,
+	}
+	return nil
+}
+
+func (mr *memoryAuthRepository) FindRefreshTokenById(id string, _ context.Context) (*StoredRefreshToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	token, ok := mr.refreshTokens[id]
+	if !ok {
+		return nil, errors.New("refresh token invalid")
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (mr *memoryAuthRepository) MarkRefreshTokenUsed(id string, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	token, ok := mr.refreshTokens[id]
+	if !ok || token.UsedAt.Valid || token.RevokedAt.Valid {
+		return errors.New("refresh token already used")
+	}
+	token.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return nil
+}
+
+func (mr *memoryAuthRepository) RevokeRefreshTokenFamily(familyId string, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, token := range mr.refreshTokens {
+		if token.FamilyId == familyId && !token.RevokedAt.Valid {
+			token.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	mr.revoked[familyId] = true
+	return nil
+}
+
+func (mr *memoryAuthRepository) CreateUserToken(data *UserToken, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for hash, token := range mr.userTokens {
+		if token.UserId == data.UserId && token.Purpose == data.Purpose {
+			mr.usedTokens[hash] = true
+		}
+	}
+	token := *data
+	mr.userTokens[data.TokenHash] = &token
+	return nil
+}
+
+func (mr *memoryAuthRepository) FindUserToken(tokenHash string, purpose string, _ context.Context) (*UserToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	token, ok := mr.userTokens[tokenHash]
+	if !ok || token.Purpose != purpose || mr.usedTokens[tokenHash] || time.Now().After(token.ExpiresAt) {
+		return nil, errors.New("link is invalid or has expired")
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (mr *memoryAuthRepository) UseUserToken(tokenHash string, purpose string, ctx context.Context) (*UserToken, error) {
+	token, err := mr.FindUserToken(tokenHash, purpose, ctx)
+	if err != nil {
+		return nil, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.usedTokens[tokenHash] {
+		return nil, errors.New("link is invalid or has expired")
+	}
+	mr.usedTokens[tokenHash] = true
+	return token, nil
+}
+
+func (mr *memoryAuthRepository) UseTotpStep(userId int64, step int64, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if lastStep, ok := mr.totpSteps[userId]; ok && lastStep >= step {
+		return errors.New("two factor code is incorrect")
+	}
+	mr.totpSteps[userId] = step
+	return nil
+}
+
+func (mr *memoryAuthRepository) UseRecoveryCode(userId int64, codeHash string, _ context.Context) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	key := strconv.FormatInt(userId, 10) + " " + codeHash
+	if unused, ok := mr.recoveryCodes[key]; !ok || !unused {
+		return errors.New("recovery code is incorrect")
+	}
+	mr.recoveryCodes[key] = false
+	return nil
+}
+
+func (mr *memoryAuthRepository) SaveAuditEvent(*AuditEvent, context.Context) error {
+	return nil
+}
+
+func newTestService(repository AuthRepository, config Config) *AuthServiceImpl {
+	if config.PasswordHasher == nil {
+		config.PasswordHasher = NewPasswordHasher(BcryptAlgorithm{Cost: bcrypt.MinCost})
+	}
+	if config.Cookies == nil {
+		config.Cookies = &CookieIssuer{SameSite: http.SameSiteLaxMode}
+	}
+	if config.LoginMaxAttempts == 0 {
+		config.LoginMaxAttempts = 5
+	}
+	if config.LoginBaseLockout == 0 {
+		config.LoginBaseLockout = time.Minute
+		config.LoginMaxLockout = time.Hour
+	}
+	keyRing := NewKeyRing(NewHMACKey("test", []byte("test signing key")))
+	return NewAuthService(repository, validator.New(), keyRing, nil, config)
+}
+
+func newTestServer(t *testing.T, repository AuthRepository, config Config) *echo.Echo {
+	t.Helper()
+	ipExtractor, err := lib.NewIPExtractorFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.IPExtractor = ipExtractor
+	authService := newTestService(repository, config)
+	authHandler := NewAuthHandler(authService, nil, authService.config)
+	e.POST("/api/signin", authHandler.SignInHandler)
+	e.POST("/api/signin/magic-link", authHandler.RequestMagicLinkHandler)
+	e.POST("/api/password/reset", authHandler.RequestPasswordResetHandler)
+	return e
+}
+
+func TestSignInIpLockoutIgnoresForwardedFor(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	e := newTestServer(t, fakeAuthRepository{}, Config{
+		LoginMaxAttempts:      5,
+		LoginMaxAttemptsPerIp: 3,
+		LoginBaseLockout:      time.Minute,
+		LoginMaxLockout:       time.Hour,
+	})
+
+	// a new username and a new forged address every time, only the
+	// connection address stays the same
+	for i := 0; i < 4; i++ {
+		body := `{"username":"user` + strconv.Itoa(i) + `","password":"wrong password"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/signin", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113."+strconv.Itoa(i))
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113."+strconv.Itoa(i))
+		req.RemoteAddr = "198.51.100.7:4321"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		want := http.StatusBadRequest
+		if i == 3 {
+			want = http.StatusTooManyRequests
+		}
+		if rec.Code != want {
+			t.Fatalf("attempt %d: got status %d, want %d: %s", i+1, rec.Code, want, rec.Body.String())
+		}
+	}
+}
+
+func TestRequestMagicLinkThrottle(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	e := newTestServer(t, fakeAuthRepository{}, Config{
+		MagicLinkMaxRequests:  2,
+		LoginMaxAttemptsPerIp: 4,
+		LoginBaseLockout:      time.Minute,
+		LoginMaxLockout:       time.Hour,
+	})
+
+	requestLink := func(login, remoteAddr string) *httptest.ResponseRecorder {
+		body := `{"login":"` + login + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/signin/magic-link", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the same login from different addresses
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		rec := requestLink("Someone@example.com", "198.51.100."+strconv.Itoa(i)+":4321")
+		if rec.Code != want {
+			t.Fatalf("login request %d: got status %d, want %d: %s", i+1, rec.Code, want, rec.Body.String())
+		}
+	}
+	if rec := requestLink("someone@example.com", "198.51.100.9:4321"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login is not case sensitive: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	// different logins from the same address
+	for i := 0; i < 5; i++ {
+		want := http.StatusAccepted
+		if i == 4 {
+			want = http.StatusTooManyRequests
+		}
+		rec := requestLink("user"+strconv.Itoa(i)+"@example.com", "203.0.113.7:4321")
+		if rec.Code != want {
+			t.Fatalf("ip request %d: got status %d, want %d: %s", i+1, rec.Code, want, rec.Body.String())
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Fatal("throttled response has no Retry-After header")
+		}
+	}
+}
+
+func TestRequestPasswordResetThrottle(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	e := newTestServer(t, fakeAuthRepository{}, Config{
+		PasswordResetMaxRequests: 2,
+		LoginMaxAttemptsPerIp:    4,
+		LoginBaseLockout:         time.Minute,
+		LoginMaxLockout:          time.Hour,
+	})
+
+	requestReset := func(username, remoteAddr string) *httptest.ResponseRecorder {
+		body := `{"username":"` + username + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/password/reset", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the same username from different addresses
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		rec := requestReset("someone", "198.51.100."+strconv.Itoa(i)+":4321")
+		if rec.Code != want {
+			t.Fatalf("username request %d: got status %d, want %d: %s", i+1, rec.Code, want, rec.Body.String())
+		}
+	}
+
+	// different usernames from the same address
+	for i := 0; i < 5; i++ {
+		want := http.StatusAccepted
+		if i == 4 {
+			want = http.StatusTooManyRequests
+		}
+		rec := requestReset("user"+strconv.Itoa(i), "203.0.113.7:4321")
+		if rec.Code != want {
+			t.Fatalf("ip request %d: got status %d, want %d: %s", i+1, rec.Code, want, rec.Body.String())
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Fatal("throttled response has no Retry-After header")
+		}
+	}
+}
+
+// unverifiedUserRepository holds a user waiting for their email to be
+// verified, storing tokens fails so no mail is sent.
+type unverifiedUserRepository struct {
+	fakeAuthRepository
+}
+
+func (unverifiedUserRepository) FindUserById(id int64, _ context.Context) (*User, error) {
+	return &User{Id: id, Username: "someone", Email: "someone@example.com"}, nil
+}
+
+func (unverifiedUserRepository) CreateUserToken(*UserToken, context.Context) error {
+	return errors.New("failed to create token")
+}
+
+func TestResendEmailVerificationThrottle(t *testing.T) {
+	authService := newTestService(unverifiedUserRepository{}, Config{
+		EmailVerificationMaxRequests: 2,
+		LoginBaseLockout:             time.Minute,
+		LoginMaxLockout:              time.Hour,
+	})
+
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		r := authService.ResendEmailVerification(&AccessToken{UserId: 1}, context.Background())
+		if r.Code != want {
+			t.Fatalf("request %d: got status %d, want %d", i+1, r.Code, want)
+		}
+	}
+	// other users are not affected
+	if r := authService.ResendEmailVerification(&AccessToken{UserId: 2}, context.Background()); r.Code != http.StatusAccepted {
+		t.Fatalf("other user: got status %d, want %d", r.Code, http.StatusAccepted)
+	}
+}
+
+// demotedAdminRepository holds a user that was an admin when their access
+// token was issued and is an author now.
+type demotedAdminRepository struct {
+	fakeAuthRepository
+}
+
+func (demotedAdminRepository) FindUserById(id int64, _ context.Context) (*User, error) {
+	return &User{Id: id, Username: "former admin", Role: ROLE_AUTHOR}, nil
+}
+
+func TestRequireRoleChecksCurrentRole(t *testing.T) {
+	authMiddleware := NewAuthMiddleware(demotedAdminRepository{}, nil, Config{})
+	handler := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	tests := map[string]echo.MiddlewareFunc{
+		"role":       authMiddleware.RequireRole(ROLE_ADMIN),
+		"permission": authMiddleware.RequirePermission(PERMISSION_MANAGE_USERS),
+	}
+
+	for name, middleware := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/users", nil), rec)
+			c.Set("accessToken", AccessToken{UserId: 1, Username: "former admin", Role: ROLE_ADMIN})
+
+			if err := middleware(handler)(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		// expired signs the refresh token of the sign in as already expired
+		expired bool
+		// refreshes lists which token every refresh presents, 0 is the one
+		// from the sign in and every successful refresh adds the next one
+		refreshes []int
+		wantCodes []int
+	}{
+		{
+			name:      "rotation issues a new token",
+			refreshes: []int{0, 1, 2},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:      "reusing a rotated token is rejected",
+			refreshes: []int{0, 0},
+			wantCodes: []int{http.StatusOK, http.StatusUnauthorized},
+		},
+		{
+			name:      "reuse revokes the whole family",
+			refreshes: []int{0, 1, 0, 2},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized},
+		},
+		{
+			name:      "expired token is rejected",
+			expired:   true,
+			refreshes: []int{0},
+			wantCodes: []int{http.StatusUnauthorized},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := newMemoryAuthRepository(&User{Id: 1, Username: "someone", Role: ROLE_AUTHOR})
+			authService := newTestService(repository, Config{})
+			ctx := context.Background()
+
+			user, _ := repository.FindUserById(1, ctx)
+			_, signInToken, errorResponse := authService.issueTokens(user, "", ctx)
+			if errorResponse != nil {
+				t.Fatal(errorResponse.Error.Message)
+			}
+			if test.expired {
+				signInToken.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			}
+			signed, err := authService.keyRing.Sign(signInToken, JWT_TYPE_REFRESH_TOKEN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refreshTokens := []string{signed}
+
+			for i, presented := range test.refreshes {
+				_, refreshToken, response := authService.RefreshToken(refreshTokens[presented], ctx)
+				if response != nil {
+					if response.Code != test.wantCodes[i] {
+						t.Fatalf("refresh %d: got status %d, want %d", i+1, response.Code, test.wantCodes[i])
+					}
+					continue
+				}
+				if test.wantCodes[i] != http.StatusOK {
+					t.Fatalf("refresh %d: got new tokens, want status %d", i+1, test.wantCodes[i])
+				}
+				if refreshToken.FamilyId != signInToken.FamilyId {
+					t.Fatalf("refresh %d: rotated into family %v, want %v", i+1, refreshToken.FamilyId, signInToken.FamilyId)
+				}
+				signed, err := authService.keyRing.Sign(refreshToken, JWT_TYPE_REFRESH_TOKEN)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, previous := range refreshTokens {
+					if previous == signed {
+						t.Fatalf("refresh %d: got a token that was already issued", i+1)
+					}
+				}
+				refreshTokens = append(refreshTokens, signed)
+			}
+		})
+	}
+}
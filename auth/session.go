@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+func (asi *AuthServiceImpl) GetSessions(accessToken *AccessToken, ctx context.Context) *web.Response {
+	sessions, err := asi.AuthRepository.FindSessionsByUserId(accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == accessToken.SessionId
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   sessions,
+	}
+}
+
+// RevokeSession signs a single device out, its refresh token stops working
+// right away and so do access tokens that were issued to it.
+func (asi *AuthServiceImpl) RevokeSession(accessToken *AccessToken, data *SessionRequest, ctx context.Context) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	err := asi.AuthRepository.RevokeSession(accessToken.UserId, data.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusNoContent,
+	}
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// LoginThrottle counts failed sign in attempts per key (username or ip
+// address). Once a key reaches its threshold every further failure blocks it
+// for twice as long as the previous one, up to maxLockout.
+type LoginThrottle struct {
+	mu          sync.Mutex
+	attempts    map[string]*loginAttempts
+	baseLockout time.Duration
+	maxLockout  time.Duration
+	lastSweep   time.Time
+}
+
+func NewLoginThrottle(baseLockout, maxLockout time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		attempts:    map[string]*loginAttempts{},
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+		lastSweep:   time.Now(),
+	}
+}
+
+// RetryAfter returns how long the key is still blocked for, zero when it can
+// try again.
+func (lt *LoginThrottle) RetryAfter(key string) time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	attempts, ok := lt.attempts[key]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(attempts.blockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (lt *LoginThrottle) Failure(key string, threshold int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.sweep()
+
+	attempts, ok := lt.attempts[key]
+	if !ok || time.Since(attempts.lastFailure) > lt.maxLockout {
+		attempts = &loginAttempts{}
+		lt.attempts[key] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailure = time.Now()
+	if attempts.failures < threshold {
+		return
+	}
+
+	exponent := float64(attempts.failures - threshold)
+	lockout := time.Duration(float64(lt.baseLockout) * math.Pow(2, exponent))
+	if lockout > lt.maxLockout || lockout <= 0 {
+		lockout = lt.maxLockout
+	}
+	attempts.blockedUntil = time.Now().Add(lockout)
+}
+
+func (lt *LoginThrottle) Reset(key string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	delete(lt.attempts, key)
+}
+
+// sweep forgets keys that have been quiet for longer than the longest
+// lockout, so the map does not grow forever. Callers must hold the lock.
+func (lt *LoginThrottle) sweep() {
+	if time.Since(lt.lastSweep) < lt.maxLockout {
+		return
+	}
+	for key, attempts := range lt.attempts {
+		if time.Since(attempts.lastFailure) > lt.maxLockout && time.Now().After(attempts.blockedUntil) {
+			delete(lt.attempts, key)
+		}
+	}
+	lt.lastSweep = time.Now()
+}
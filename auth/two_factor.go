@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const TWO_FACTOR_CHALLENGE_PURPOSE = "two_factor"
+const TWO_FACTOR_CHALLENGE_TTL = time.Minute * 5
+
+// TWO_FACTOR_CHALLENGE_MAX_ATTEMPTS is how many wrong codes one challenge
+// takes before it stops working and the password has to be entered again
+const TWO_FACTOR_CHALLENGE_MAX_ATTEMPTS = 5
+const RECOVERY_CODE_COUNT = 10
+
+// TwoFactorChallenge proves the password step of a sign in succeeded, it is
+// exchanged for real tokens together with a two factor code. Its id is
+// stored as a user token so it can only be exchanged once.
+type TwoFactorChallenge struct {
+	Purpose string `json:"purpose"`
+	UserId  int64  `json:"id"`
+	jwt.RegisteredClaims
+}
+
+func (asi *AuthServiceImpl) EnrollTotp(accessToken *AccessToken, ctx context.Context) *web.Response {
+	secret := newTotpSecret()
+	err := asi.AuthRepository.SaveTotpSecret(accessToken.UserId, secret, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: TotpEnrollmentResponse{
+			Secret:          secret,
+			ProvisioningURI: totpProvisioningURI(asi.config.TotpIssuer, accessToken.Username, secret),
+		},
+	}
+}
+
+// ConfirmTotp enables two factor once the user proves the authenticator app
+// was set up correctly, the recovery codes are only ever returned here.
+func (asi *AuthServiceImpl) ConfirmTotp(accessToken *AccessToken, data *TotpCodeRequest, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_TOTP_ENABLE, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil || user.TotpSecret == "" || user.TotpEnabled {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: "there is no two factor enrollment in progress",
+			},
+		}
+	}
+	if errorResponse := asi.verifyTotp(user, data.Code, ctx); errorResponse != nil {
+		return errorResponse
+	}
+
+	recoveryCodes := newRecoveryCodes(RECOVERY_CODE_COUNT)
+	recoveryCodeHashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		recoveryCodeHashes[i] = hashRecoveryCode(code)
+	}
+	err = asi.AuthRepository.EnableTotp(user.Id, recoveryCodeHashes, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   RecoveryCodesResponse{RecoveryCodes: recoveryCodes},
+	}
+}
+
+func (asi *AuthServiceImpl) DisableTotp(accessToken *AccessToken, data *TotpCodeRequest, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_TOTP_DISABLE, UserId: accessToken.UserId, Username: accessToken.Username}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(accessToken.UserId, ctx)
+	if err != nil || !user.TotpEnabled {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusConflict,
+			Error: web.Error{
+				Message: "two factor authentication is not enabled",
+			},
+		}
+	}
+	if errorResponse := asi.verifyTotp(user, data.Code, ctx); errorResponse != nil {
+		return errorResponse
+	}
+
+	err = asi.AuthRepository.DisableTotp(user.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+	}
+}
+
+// SignInTwoFactor is the second step of SignIn for accounts with two factor
+// enabled.
+func (asi *AuthServiceImpl) SignInTwoFactor(
+	data *TwoFactorSignInRequest, ctx context.Context,
+) (accessToken *AccessToken, refreshToken *RefreshToken, response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_SIGN_IN_TWO_FACTOR}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return nil, nil, errorResponse
+	}
+
+	expired := &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusUnauthorized,
+		Error: web.Error{
+			Message: "sign in has expired, please sign in again",
+		},
+	}
+	challenge := &TwoFactorChallenge{}
+	err := asi.keyRing.Parse(data.ChallengeToken, challenge, JWT_TYPE_TWO_FACTOR_CHALLENGE)
+	if err != nil || challenge.Purpose != TWO_FACTOR_CHALLENGE_PURPOSE || challenge.ID == "" {
+		return nil, nil, expired
+	}
+	event.UserId = challenge.UserId
+
+	challengeHash := hashSecretToken(challenge.ID)
+	_, err = asi.AuthRepository.FindUserToken(challengeHash, USER_TOKEN_TWO_FACTOR_CHALLENGE, ctx)
+	if err != nil {
+		return nil, nil, expired
+	}
+
+	user, err := asi.AuthRepository.FindUserById(challenge.UserId, ctx)
+	if err != nil || !user.TotpEnabled {
+		return nil, nil, expired
+	}
+
+	event.Username = user.Username
+	var errorResponse *web.Response
+	if data.Code != "" {
+		errorResponse = asi.verifyTotp(user, data.Code, ctx)
+	} else {
+		event.Detail = "recovery code"
+		errorResponse = asi.verifyRecoveryCode(user, data.RecoveryCode, ctx)
+	}
+	challengeKey := "two_factor_challenge:" + challenge.ID
+	if errorResponse != nil {
+		// the user wide lockout lets a challenge keep guessing slowly, every
+		// challenge only gets a few tries on top of it
+		asi.loginThrottle.Failure(challengeKey, TWO_FACTOR_CHALLENGE_MAX_ATTEMPTS)
+		if asi.loginThrottle.RetryAfter(challengeKey) > 0 {
+			asi.AuthRepository.UseUserToken(challengeHash, USER_TOKEN_TWO_FACTOR_CHALLENGE, ctx)
+		}
+		return nil, nil, errorResponse
+	}
+	asi.loginThrottle.Reset(challengeKey)
+
+	// using the challenge is what makes it single use, a replay running
+	// alongside this one gets no tokens
+	_, err = asi.AuthRepository.UseUserToken(challengeHash, USER_TOKEN_TWO_FACTOR_CHALLENGE, ctx)
+	if err != nil {
+		return nil, nil, expired
+	}
+	return asi.issueTokens(user, "", ctx)
+}
+
+func (asi *AuthServiceImpl) newTwoFactorChallenge(user *User, ctx context.Context) *web.Response {
+	failed := &web.Response{
+		Status: web.STATUS_FAIL,
+		Code:   http.StatusInternalServerError,
+		Error: web.Error{
+			Message: "failed to sign in, please try again",
+		},
+	}
+	challengeId := newTokenId()
+	expiresAt := time.Now().Add(TWO_FACTOR_CHALLENGE_TTL)
+	err := asi.AuthRepository.CreateUserToken(&UserToken{
+		UserId:    user.Id,
+		Purpose:   USER_TOKEN_TWO_FACTOR_CHALLENGE,
+		TokenHash: hashSecretToken(challengeId),
+		ExpiresAt: expiresAt,
+	}, ctx)
+	if err != nil {
+		return failed
+	}
+
+	challenge, err := asi.keyRing.Sign(&TwoFactorChallenge{
+		Purpose: TWO_FACTOR_CHALLENGE_PURPOSE,
+		UserId:  user.Id,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        challengeId,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}, JWT_TYPE_TWO_FACTOR_CHALLENGE)
+	if err != nil {
+		return failed
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: TwoFactorChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+		},
+	}
+}
+
+// verifyTotp is throttled like the password step, otherwise the six digits
+// could simply be guessed.
+func (asi *AuthServiceImpl) verifyTotp(user *User, code string, ctx context.Context) *web.Response {
+	return asi.throttleTwoFactor(user, func() error {
+		step, ok := validateTotp(user.TotpSecret, code, time.Now())
+		if !ok {
+			return errors.New("two factor code is incorrect")
+		}
+		return asi.AuthRepository.UseTotpStep(user.Id, step, ctx)
+	})
+}
+
+func (asi *AuthServiceImpl) verifyRecoveryCode(user *User, code string, ctx context.Context) *web.Response {
+	return asi.throttleTwoFactor(user, func() error {
+		return asi.AuthRepository.UseRecoveryCode(user.Id, hashRecoveryCode(code), ctx)
+	})
+}
+
+func (asi *AuthServiceImpl) throttleTwoFactor(user *User, verify func() error) *web.Response {
+	return asi.throttleAttempts("two_factor:"+strconv.FormatInt(user.Id, 10), verify)
+}
+
+// throttleAttempts locks key out after too many failed calls to verify, the
+// same way SignIn does for usernames.
+func (asi *AuthServiceImpl) throttleAttempts(key string, verify func() error) *web.Response {
+	if retryAfter := asi.loginThrottle.RetryAfter(key); retryAfter > 0 {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusTooManyRequests,
+			Error: web.Error{
+				Message: "too many failed attempts, please try again later",
+				Detail:  RetryAfterDetail{RetryAfter: int(math.Ceil(retryAfter.Seconds()))},
+			},
+		}
+	}
+
+	if err := verify(); err != nil {
+		asi.loginThrottle.Failure(key, asi.config.LoginMaxAttempts)
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	asi.loginThrottle.Reset(key)
+	return nil
+}
+
+// throttleRequests counts the request against every key in limits, which
+// maps a key to its threshold, and refuses it while any of them is locked
+// out. Unlike throttleAttempts every request counts, it is meant for
+// requests that send a mail whether they succeed or not.
+func (asi *AuthServiceImpl) throttleRequests(message string, limits map[string]int) *web.Response {
+	var retryAfter time.Duration
+	for key := range limits {
+		retryAfter = max(retryAfter, asi.loginThrottle.RetryAfter(key))
+	}
+	if retryAfter > 0 {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusTooManyRequests,
+			Error: web.Error{
+				Message: message,
+				Detail:  RetryAfterDetail{RetryAfter: int(math.Ceil(retryAfter.Seconds()))},
+			},
+		}
+	}
+	for key, threshold := range limits {
+		asi.loginThrottle.Failure(key, threshold)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTwoFactorTestService returns a service with user 1 having two factor
+// enabled, and a recovery code of theirs.
+func newTwoFactorTestService(t *testing.T) (*AuthServiceImpl, *User, string) {
+	t.Helper()
+	user := &User{Id: 1, Username: "someone", Role: ROLE_AUTHOR, TotpEnabled: true, TotpSecret: newTotpSecret()}
+	repository := newMemoryAuthRepository(user)
+	recoveryCode := newRecoveryCodes(1)[0]
+	repository.recoveryCodes[strconv.FormatInt(user.Id, 10)+" "+hashRecoveryCode(recoveryCode)] = true
+
+	// high enough that the lockout of the user never gets in the way of the
+	// limit of a single challenge
+	authService := newTestService(repository, Config{LoginMaxAttempts: 100})
+	return authService, user, recoveryCode
+}
+
+// newChallenge is what SignIn returns after the password was right.
+func newChallenge(t *testing.T, authService *AuthServiceImpl, user *User) string {
+	t.Helper()
+	response := authService.newTwoFactorChallenge(user, context.Background())
+	challenge, ok := response.Data.(TwoFactorChallengeResponse)
+	if !ok {
+		t.Fatalf("no challenge: %+v", response)
+	}
+	return challenge.ChallengeToken
+}
+
+func totpCodeAt(t *testing.T, user *User, step int64) string {
+	t.Helper()
+	code, err := totpCode(user.TotpSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// wrongTotpCode returns a code that is not valid anywhere in the skew window.
+func wrongTotpCode(t *testing.T, user *User) string {
+	t.Helper()
+	for candidate := 0; ; candidate++ {
+		code := strconv.Itoa(100000 + candidate)
+		if _, ok := validateTotp(user.TotpSecret, code, time.Now()); !ok {
+			return code
+		}
+	}
+}
+
+func signInTwoFactor(authService *AuthServiceImpl, data *TwoFactorSignInRequest) int {
+	_, _, response := authService.SignInTwoFactor(data, context.Background())
+	if response == nil {
+		return http.StatusOK
+	}
+	return response.Code
+}
+
+func TestSignInTwoFactorRejectsReplayedTotpStep(t *testing.T) {
+	authService, user, _ := newTwoFactorTestService(t)
+	code := totpCodeAt(t, user, time.Now().Unix()/TOTP_PERIOD)
+
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: newChallenge(t, authService, user), Code: code,
+	}); got != http.StatusOK {
+		t.Fatalf("first use of the code: got status %d, want %d", got, http.StatusOK)
+	}
+	// a new challenge, as if the password was entered again
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: newChallenge(t, authService, user), Code: code,
+	}); got != http.StatusBadRequest {
+		t.Fatalf("replayed code: got status %d, want %d", got, http.StatusBadRequest)
+	}
+}
+
+func TestSignInTwoFactorRecoveryCodeIsSingleUse(t *testing.T) {
+	authService, user, recoveryCode := newTwoFactorTestService(t)
+
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: newChallenge(t, authService, user), RecoveryCode: recoveryCode,
+	}); got != http.StatusOK {
+		t.Fatalf("first use of the recovery code: got status %d, want %d", got, http.StatusOK)
+	}
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: newChallenge(t, authService, user), RecoveryCode: recoveryCode,
+	}); got != http.StatusBadRequest {
+		t.Fatalf("second use of the recovery code: got status %d, want %d", got, http.StatusBadRequest)
+	}
+}
+
+func TestSignInTwoFactorChallengeIsSingleUse(t *testing.T) {
+	authService, user, _ := newTwoFactorTestService(t)
+	challenge := newChallenge(t, authService, user)
+	step := time.Now().Unix() / TOTP_PERIOD
+
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: challenge, Code: totpCodeAt(t, user, step),
+	}); got != http.StatusOK {
+		t.Fatalf("first use of the challenge: got status %d, want %d", got, http.StatusOK)
+	}
+	// a valid code the user has not used yet, only the challenge is replayed
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: challenge, Code: totpCodeAt(t, user, step+1),
+	}); got != http.StatusUnauthorized {
+		t.Fatalf("replayed challenge: got status %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestSignInTwoFactorLimitsAttemptsPerChallenge(t *testing.T) {
+	authService, user, _ := newTwoFactorTestService(t)
+	challenge := newChallenge(t, authService, user)
+	wrongCode := wrongTotpCode(t, user)
+
+	for i := 0; i < TWO_FACTOR_CHALLENGE_MAX_ATTEMPTS; i++ {
+		if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+			ChallengeToken: challenge, Code: wrongCode,
+		}); got != http.StatusBadRequest {
+			t.Fatalf("wrong code %d: got status %d, want %d", i+1, got, http.StatusBadRequest)
+		}
+	}
+
+	code := totpCodeAt(t, user, time.Now().Unix()/TOTP_PERIOD)
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: challenge, Code: code,
+	}); got != http.StatusUnauthorized {
+		t.Fatalf("right code after too many wrong ones: got status %d, want %d", got, http.StatusUnauthorized)
+	}
+	// entering the password again gives a challenge that works
+	if got := signInTwoFactor(authService, &TwoFactorSignInRequest{
+		ChallengeToken: newChallenge(t, authService, user), Code: code,
+	}); got != http.StatusOK {
+		t.Fatalf("new challenge: got status %d, want %d", got, http.StatusOK)
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/zulfikarrosadi/go-blog-api/web"
+)
+
+const USER_LIST_DEFAULT_PER_PAGE = 20
+
+func (asi *AuthServiceImpl) GetUsers(data *UserListRequest, ctx context.Context) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	if data.Page == 0 {
+		data.Page = 1
+	}
+	if data.PerPage == 0 {
+		data.PerPage = USER_LIST_DEFAULT_PER_PAGE
+	}
+
+	users, total, err := asi.AuthRepository.FindUsers(data, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data: UserListResponse{
+			Users:   users,
+			Page:    data.Page,
+			PerPage: data.PerPage,
+			Total:   total,
+		},
+	}
+}
+
+func (asi *AuthServiceImpl) GetUser(data *UserRequest, ctx context.Context) *web.Response {
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	user, err := asi.AuthRepository.FindUserById(data.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: "user not found",
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusOK,
+		Data:   user,
+	}
+}
+
+// SuspendUser keeps the user from signing in until they are unsuspended,
+// they are signed out of every session straight away.
+func (asi *AuthServiceImpl) SuspendUser(
+	accessToken *AccessToken, data *SuspendUserRequest, ctx context.Context,
+) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_USER_SUSPEND, UserId: data.Id, ActorId: accessToken.UserId, Detail: data.Reason}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	if data.Id == accessToken.UserId {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusBadRequest,
+			Error: web.Error{
+				Message: "you cannot suspend yourself",
+			},
+		}
+	}
+
+	err := asi.AuthRepository.SuspendUser(data.Id, data.Reason, accessToken.UserId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return asi.revokeUserTokens(data.Id, ctx)
+}
+
+func (asi *AuthServiceImpl) UnsuspendUser(accessToken *AccessToken, data *UserRequest, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_USER_UNSUSPEND, UserId: data.Id, ActorId: accessToken.UserId}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+
+	err := asi.AuthRepository.UnsuspendUser(data.Id, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusNotFound,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusNoContent,
+	}
+}
+
+// SignOutUser signs the user out of every session and revokes their
+// personal access tokens, it does not stop them from signing in again.
+func (asi *AuthServiceImpl) SignOutUser(accessToken *AccessToken, data *UserRequest, ctx context.Context) (response *web.Response) {
+	event := &AuditEvent{Event: AUDIT_USER_SIGN_OUT, UserId: data.Id, ActorId: accessToken.UserId}
+	defer func() { asi.audit(event, response, ctx) }()
+
+	if errorResponse := asi.validateStruct(data); errorResponse != nil {
+		return errorResponse
+	}
+	return asi.revokeUserTokens(data.Id, ctx)
+}
+
+func (asi *AuthServiceImpl) revokeUserTokens(userId int64, ctx context.Context) *web.Response {
+	err := asi.AuthRepository.RevokeUserTokens(userId, ctx)
+	if err != nil {
+		return &web.Response{
+			Status: web.STATUS_FAIL,
+			Code:   http.StatusInternalServerError,
+			Error: web.Error{
+				Message: err.Error(),
+			},
+		}
+	}
+	return &web.Response{
+		Status: web.STATUS_SUCCESS,
+		Code:   http.StatusNoContent,
+	}
+}
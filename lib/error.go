@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"strings"
 
 	"github.com/VividCortex/mysqlerr"
 	"github.com/go-playground/validator/v10"
@@ -21,13 +23,57 @@ func ValidateError(validationError validator.ValidationErrors) []ErrorDetail {
 	errorDetails := []ErrorDetail{}
 
 	for _, fieldError := range validationError {
-		switch fieldError.Tag() {
-		case "required":
+		// alternatives such as "len=0|http_url" are reported by their last tag
+		tag := fieldError.Tag()
+		if i := strings.LastIndex(tag, "|"); i >= 0 {
+			tag = tag[i+1:]
+		}
+		switch tag {
+		case "required", "required_without":
 			errorDetail := ErrorDetail{
 				Path:    []string{fieldError.Field()},
 				Message: fieldError.Field() + " is required",
 			}
 			errorDetails = append(errorDetails, errorDetail)
+		case "oneof":
+			errorDetail := ErrorDetail{
+				Path:    []string{fieldError.Field()},
+				Value:   fmt.Sprint(fieldError.Value()),
+				Message: fieldError.Field() + " must be one of: " + strings.ReplaceAll(fieldError.Param(), " ", ", "),
+			}
+			errorDetails = append(errorDetails, errorDetail)
+		case "min", "max":
+			bound := "at least " + fieldError.Param()
+			if tag == "max" {
+				bound = "at most " + fieldError.Param()
+			}
+			message := fieldError.Field() + " must be " + bound
+			switch fieldError.Kind() {
+			case reflect.String:
+				message += " characters long"
+			case reflect.Slice:
+				message = fieldError.Field() + " must have " + bound + " items"
+			}
+			errorDetail := ErrorDetail{
+				Path:    []string{fieldError.Field()},
+				Value:   fmt.Sprint(fieldError.Value()),
+				Message: message,
+			}
+			errorDetails = append(errorDetails, errorDetail)
+		case "url", "http_url":
+			errorDetail := ErrorDetail{
+				Path:    []string{fieldError.Field()},
+				Value:   fmt.Sprint(fieldError.Value()),
+				Message: fieldError.Field() + " must be a valid url",
+			}
+			errorDetails = append(errorDetails, errorDetail)
+		case "datetime":
+			errorDetail := ErrorDetail{
+				Path:    []string{fieldError.Field()},
+				Value:   fmt.Sprint(fieldError.Value()),
+				Message: fieldError.Field() + " must be a date and time like " + fieldError.Param(),
+			}
+			errorDetails = append(errorDetails, errorDetail)
 		case "email":
 			errorDetail := ErrorDetail{
 				Path:    []string{fieldError.Field()},
@@ -73,7 +119,7 @@ func ValidateErrorV2(action string, err error) {
 
 	// check for database connection error
 	// eg: port error, protocol error, etc
-	if newErr := err.(*net.OpError); newErr != nil {
+	if newErr, ok := err.(*net.OpError); ok {
 		ErrorLog(action, "database connection error", newErr)
 	}
 }
@@ -6,14 +6,20 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/zulfikarrosadi/go-blog-api/web"
 )
 
+// UploadedResponse lists every stored file in FileNames. FileName predates
+// multiple uploads and is kept for clients that send a single file, it is
+// only set when exactly one file was uploaded.
 type UploadedResponse struct {
-	FileName string `json:"fileName"`
+	FileName  string   `json:"fileName"`
+	FileNames []string `json:"fileNames"`
 }
 
 const MAX_UPLOAD_SIZE = 1024 * 1024 // 1MB
@@ -26,6 +32,7 @@ func FileUploadHandler(c echo.Context) error {
 	}
 
 	files := form.File["files"]
+	fileNames := []string{}
 	for _, file := range files {
 		src, err := file.Open()
 		if err != nil {
@@ -59,7 +66,8 @@ func FileUploadHandler(c echo.Context) error {
 			return err
 		}
 
-		dst, err := os.Create(fmt.Sprintf("./%v%v", time.Now().UnixNano(), file.Filename))
+		fileName := fmt.Sprintf("%v%v", time.Now().UnixNano(), filepath.Base(file.Filename))
+		dst, err := os.Create("./" + fileName)
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -70,13 +78,31 @@ func FileUploadHandler(c echo.Context) error {
 			fmt.Println(err)
 			return err
 		}
+		fileNames = append(fileNames, fileName)
 	}
 
+	uploaded := UploadedResponse{FileNames: fileNames}
+	if len(fileNames) == 1 {
+		uploaded.FileName = fileNames[0]
+	}
 	response := web.Response{
 		Status: "success",
-		Data: UploadedResponse{
-			FileName: "someshit",
-		},
+		Data:   uploaded,
 	}
 	return c.JSON(http.StatusOK, response)
 }
+
+// uploadedFileName matches the names FileUploadHandler stores files under,
+// the timestamp prefix keeps references away from other files in the
+// working directory
+var uploadedFileName = regexp.MustCompile(`^[0-9]{16,}[^/\\]*$`)
+
+// UploadedFileExists reports whether name is a file FileUploadHandler stored,
+// use it to check file references sent by clients.
+func UploadedFileExists(name string) bool {
+	if !uploadedFileName.MatchString(name) || filepath.Base(name) != name {
+		return false
+	}
+	info, err := os.Stat("./" + name)
+	return err == nil && info.Mode().IsRegular()
+}
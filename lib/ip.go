@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewIPExtractorFromEnv decides where c.RealIP() takes the client ip address
+// from. Without TRUSTED_PROXIES it is the address of the connection, the
+// X-Forwarded-For and X-Real-IP headers are made up by the client and would
+// let anybody pick their ip address. TRUSTED_PROXIES is a comma separated
+// list of the cidr ranges of the proxies in front of the api, only the
+// X-Forwarded-For entries they appended are believed.
+func NewIPExtractorFromEnv() (echo.IPExtractor, error) {
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("TRUSTED_PROXIES must be a comma separated list of cidr ranges, got " + cidr)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	if len(options) == 3 {
+		return echo.ExtractIPDirect(), nil
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(context.Context, Mail) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+func (sm *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	var auth smtp.Auth
+	if sm.Username != "" {
+		auth = smtp.PlainAuth("", sm.Username, sm.Password, sm.Host)
+	}
+	addr := net.JoinHostPort(sm.Host, strconv.Itoa(sm.Port))
+	return smtp.SendMail(addr, auth, sm.From, []string{mail.To}, buildMessage(sm.From, mail))
+}
+
+// LogMailer writes mails to a file instead of sending them, it is meant for
+// local development where there is no smtp server around.
+type LogMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+func (lm *LogMailer) Send(ctx context.Context, mail Mail) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	_, err := fmt.Fprintf(lm.w, "----- %v -----\r\n%s\r\n", time.Now().Format(time.RFC3339), buildMessage("", mail))
+	return err
+}
+
+// NewMailerFromEnv returns an smtp mailer when MAILER=smtp, otherwise mails
+// are appended to MAILER_LOG_FILE (mail.log by default).
+func NewMailerFromEnv() (Mailer, error) {
+	if GetEnv("MAILER", "log") == "smtp" {
+		return NewSMTPMailer(
+			GetEnv("SMTP_HOST", "localhost"),
+			GetEnvInt("SMTP_PORT", 587),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			GetEnv("SMTP_FROM", "no-reply@localhost"),
+		), nil
+	}
+
+	f, err := os.OpenFile(GetEnv("MAILER_LOG_FILE", "mail.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogMailer(f), nil
+}
+
+func buildMessage(from string, mail Mail) []byte {
+	headers := []string{}
+	if from != "" {
+		headers = append(headers, "From: "+from)
+	}
+	headers = append(headers,
+		"To: "+mail.To,
+		"Subject: "+mail.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+	)
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + mail.Body + "\r\n")
+}
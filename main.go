@@ -1,24 +1,44 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/sirupsen/logrus"
+	"github.com/zulfikarrosadi/go-blog-api/account"
 	"github.com/zulfikarrosadi/go-blog-api/article"
 	"github.com/zulfikarrosadi/go-blog-api/auth"
 	"github.com/zulfikarrosadi/go-blog-api/lib"
 )
 
 func main() {
+	// a missing .env is fine, the variables can come from the environment
+	godotenv.Load()
+
 	e := echo.New()
 	validator := validator.New()
 	db := GetDBConnection()
 
+	ipExtractor, err := lib.NewIPExtractorFromEnv()
+	if err != nil {
+		lib.Logrus.WithFields(logrus.Fields{
+			"timestamp": time.Now(),
+			"details":   err.Error(),
+			"context": map[string]any{
+				"action": "load_trusted_proxies",
+			},
+		}).Fatal("Failed to load trusted proxies")
+	}
+	// sign in throttling, sessions and the audit log all rely on the client
+	// ip address, it must not come from headers the client controls
+	e.IPExtractor = ipExtractor
+
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogStatus:    true,
 		LogRemoteIP:  true,
@@ -37,29 +57,111 @@ func main() {
 		},
 	}))
 
-	articleRepository := article.NewArticleRepository(GetDBConnection())
-	articleService := article.NewArticleService(articleRepository, validator)
+	// sharing the connection lets the account package delete users and
+	// their articles in one transaction
+	authRepository := auth.NewAuthRepository(db)
+	articleRepository := article.NewArticleRepository(db)
+	articleService := article.NewArticleService(articleRepository, authRepository, validator)
 	articleHandler := article.NewArticleApi(articleService)
 
-	authRepository := auth.NewAuthRepository(db)
-	authService := auth.NewAuthService(authRepository, validator)
-	authHandler := auth.NewAuthHandler(authService)
-	authMiddleware := auth.NewAuthMiddleware()
+	keyRing, err := auth.NewKeyRingFromEnv()
+	if err != nil {
+		lib.Logrus.WithFields(logrus.Fields{
+			"timestamp": time.Now(),
+			"details":   err.Error(),
+			"context": map[string]any{
+				"action": "load_signing_keys",
+			},
+		}).Fatal("Failed to load jwt signing keys")
+	}
+
+	mailer, err := lib.NewMailerFromEnv()
+	if err != nil {
+		lib.Logrus.WithFields(logrus.Fields{
+			"timestamp": time.Now(),
+			"details":   err.Error(),
+			"context": map[string]any{
+				"action": "create_mailer",
+			},
+		}).Fatal("Failed to create mailer")
+	}
+
+	authConfig, err := auth.NewConfigFromEnv()
+	if err != nil {
+		lib.Logrus.WithFields(logrus.Fields{
+			"timestamp": time.Now(),
+			"details":   err.Error(),
+			"context": map[string]any{
+				"action": "load_auth_config",
+			},
+		}).Fatal("Failed to load auth config")
+	}
+	authService := auth.NewAuthService(authRepository, validator, keyRing, mailer, authConfig)
+	accountService := account.NewAccountService(db, authRepository, articleRepository)
+	go accountService.RunPurger(context.Background())
+	authHandler := auth.NewAuthHandler(authService, keyRing, authConfig)
+	authMiddleware := auth.NewAuthMiddleware(authRepository, keyRing, authConfig)
 
 	e.POST("/api/signin", authHandler.SignInHandler)
+	e.POST("/api/signin/2fa", authHandler.SignInTwoFactorHandler)
+	e.POST("/api/signin/magic-link", authHandler.RequestMagicLinkHandler)
+	e.POST("/api/signin/magic-link/confirm", authHandler.MagicLinkSignInHandler)
 	e.POST("/api/signup", authHandler.SignUpHandler)
+	e.GET("/api/oidc/:provider", authHandler.OIDCSignInHandler)
+	e.GET("/api/oidc/:provider/callback", authHandler.OIDCCallbackHandler)
 	e.POST("/api/refresh", authHandler.RefreshTokenHandler)
+	e.GET("/.well-known/jwks.json", authHandler.JWKSHandler)
+	// for internal services only, they authenticate with client credentials
+	e.POST("/api/introspect", authHandler.IntrospectTokenHandler)
+	e.POST("/api/password/reset", authHandler.RequestPasswordResetHandler)
+	e.POST("/api/password/reset/confirm", authHandler.ResetPasswordHandler)
+	e.POST("/api/email/verify", authHandler.VerifyEmailHandler)
 
 	protectedRouteGroup := e.Group("/api/auth")
+	// refreshing is left out on purpose, it is what hands out a new csrf
+	// token and a forged refresh only rotates the victim's own cookies
+	protectedRouteGroup.Use(authMiddleware.CSRFProtection)
 	protectedRouteGroup.Use(authMiddleware.DeserializeUser)
 	protectedRouteGroup.Use(authMiddleware.AuthenticationRequired)
 
 	e.GET("/api/articles", articleHandler.GetArticles)
 	e.GET("/api/articles/:slug", articleHandler.GetArticleById)
-	protectedRouteGroup.POST("/articles", articleHandler.CreateArticle)
-	protectedRouteGroup.DELETE("/articles/:id", articleHandler.DeleteArticle)
-	protectedRouteGroup.PUT("/articles/:id", articleHandler.UpdateArticle)
-	protectedRouteGroup.POST("/files", lib.FileUploadHandler)
+	sessionRequired := authMiddleware.RequireSession
+	canWriteArticles := authMiddleware.RequirePermission(auth.PERMISSION_WRITE_ARTICLES)
+	protectedRouteGroup.POST("/articles", articleHandler.CreateArticle, canWriteArticles, authMiddleware.RequireVerifiedEmail)
+	protectedRouteGroup.DELETE("/articles/:id", articleHandler.DeleteArticle, canWriteArticles)
+	protectedRouteGroup.PUT("/articles/:id", articleHandler.UpdateArticle, canWriteArticles)
+	protectedRouteGroup.POST("/files", lib.FileUploadHandler, authMiddleware.RequirePermission(auth.PERMISSION_WRITE_FILES))
+	protectedRouteGroup.POST("/signout", authHandler.SignOutHandler, sessionRequired)
+	protectedRouteGroup.POST("/signout/everywhere", authHandler.SignOutEverywhereHandler, sessionRequired)
+	protectedRouteGroup.POST("/email/verification", authHandler.ResendEmailVerificationHandler, sessionRequired)
+	protectedRouteGroup.PUT("/email", authHandler.ChangeEmailHandler, sessionRequired)
+	protectedRouteGroup.GET("/sessions", authHandler.GetSessionsHandler, sessionRequired)
+	protectedRouteGroup.DELETE("/sessions/:id", authHandler.RevokeSessionHandler, sessionRequired)
+	protectedRouteGroup.GET("/oidc/:provider/link", authHandler.OIDCLinkHandler, sessionRequired)
+	protectedRouteGroup.POST("/2fa/totp", authHandler.EnrollTotpHandler, sessionRequired)
+	protectedRouteGroup.POST("/2fa/totp/confirm", authHandler.ConfirmTotpHandler, sessionRequired)
+	protectedRouteGroup.DELETE("/2fa/totp", authHandler.DisableTotpHandler, sessionRequired)
+	protectedRouteGroup.GET("/me", authHandler.GetCurrentUserHandler)
+	protectedRouteGroup.PATCH("/me", authHandler.UpdateProfileHandler, sessionRequired)
+	protectedRouteGroup.DELETE("/me", authHandler.DeleteAccountHandler, sessionRequired)
+	protectedRouteGroup.DELETE("/me/deletion", authHandler.CancelAccountDeletionHandler, sessionRequired)
+	protectedRouteGroup.PUT("/password", authHandler.ChangePasswordHandler, sessionRequired)
+	protectedRouteGroup.GET("/tokens", authHandler.GetPersonalAccessTokensHandler, sessionRequired)
+	protectedRouteGroup.POST("/tokens", authHandler.CreatePersonalAccessTokenHandler, sessionRequired)
+	protectedRouteGroup.DELETE("/tokens/:id", authHandler.RevokePersonalAccessTokenHandler, sessionRequired)
+	protectedRouteGroup.PUT("/users/:id/role", authHandler.UpdateUserRoleHandler, authMiddleware.RequireRole(auth.ROLE_ADMIN))
+	// tokens created with users:manage before it stopped being a personal
+	// access token scope must not keep working here
+	canManageUsers := authMiddleware.RequirePermission(auth.PERMISSION_MANAGE_USERS)
+	protectedRouteGroup.GET("/users", authHandler.GetUsersHandler, sessionRequired, canManageUsers)
+	protectedRouteGroup.GET("/users/:id", authHandler.GetUserHandler, sessionRequired, canManageUsers)
+	protectedRouteGroup.POST("/users/:id/suspension", authHandler.SuspendUserHandler, sessionRequired, canManageUsers)
+	protectedRouteGroup.DELETE("/users/:id/suspension", authHandler.UnsuspendUserHandler, sessionRequired, canManageUsers)
+	protectedRouteGroup.POST("/users/:id/signout", authHandler.SignOutUserHandler, sessionRequired, canManageUsers)
+	protectedRouteGroup.POST("/users/:id/impersonation", authHandler.ImpersonateUserHandler, authMiddleware.RequireRole(auth.ROLE_ADMIN))
+	protectedRouteGroup.GET("/audit-events", authHandler.GetAuditEventsHandler, authMiddleware.RequireRole(auth.ROLE_ADMIN))
+	protectedRouteGroup.GET("/audit-events/export", authHandler.ExportAuditEventsHandler, authMiddleware.RequireRole(auth.ROLE_ADMIN))
 
 	e.Logger.Fatal(e.Start("localhost:3000"))
 }
@@ -0,0 +1,8 @@
+CREATE TABLE revoked_access_tokens (
+    id VARCHAR(32) NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    INDEX idx_revoked_access_tokens_expires_at (expires_at)
+);
+
+ALTER TABLE users ADD COLUMN tokens_revoked_at DATETIME NULL;
@@ -0,0 +1,2 @@
+-- existing users could already write articles, so they keep doing so as authors
+ALTER TABLE users ADD COLUMN role ENUM('reader', 'author', 'editor', 'admin') NOT NULL DEFAULT 'author';
@@ -0,0 +1,16 @@
+-- where password reset and other account mails are delivered to
+ALTER TABLE users ADD COLUMN email VARCHAR(255) NULL;
+
+-- single use tokens sent to users by mail, only the sha256 of the token is
+-- stored so a database leak does not hand out working links
+CREATE TABLE user_tokens (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    purpose VARCHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE INDEX idx_user_tokens_token_hash (token_hash),
+    INDEX idx_user_tokens_user_id (user_id)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN email_verified_at DATETIME NULL,
+    ADD UNIQUE INDEX idx_users_email (email);
@@ -0,0 +1,13 @@
+ALTER TABLE users
+    ADD COLUMN totp_secret VARCHAR(64) NULL,
+    ADD COLUMN totp_enabled_at DATETIME NULL,
+    -- a code is only accepted once, even inside its 30 second window
+    ADD COLUMN totp_last_used_step BIGINT NULL;
+
+CREATE TABLE totp_recovery_codes (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at DATETIME NULL,
+    INDEX idx_totp_recovery_codes_user_id (user_id)
+);
@@ -0,0 +1,20 @@
+-- one row per sign in, the id is the family id shared by every refresh token
+-- rotated from that sign in
+CREATE TABLE sessions (
+    id VARCHAR(32) NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL,
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL,
+    INDEX idx_sessions_user_id (user_id)
+);
+
+-- sign ins from before sessions existed keep working
+INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at)
+SELECT family_id, user_id, MIN(created_at), MAX(created_at), MAX(expires_at)
+FROM refresh_tokens
+WHERE revoked_at IS NULL
+GROUP BY family_id, user_id;
@@ -0,0 +1,11 @@
+-- accounts at external openid connect providers linked to a local user
+CREATE TABLE user_identities (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE INDEX idx_user_identities_provider_subject (provider, subject),
+    INDEX idx_user_identities_user_id (user_id)
+);
@@ -0,0 +1,15 @@
+-- long lived tokens for scripts and ci, only the sha256 of the token is kept
+CREATE TABLE personal_access_tokens (
+    id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    -- space separated like oauth scopes, eg "articles:write files:write"
+    scopes VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    last_used_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    UNIQUE INDEX idx_personal_access_tokens_token_hash (token_hash),
+    INDEX idx_personal_access_tokens_user_id (user_id)
+);
@@ -0,0 +1,13 @@
+ALTER TABLE users
+    -- the account is deleted once this has passed, until then the user can
+    -- cancel the deletion
+    ADD COLUMN deletion_scheduled_at DATETIME NULL,
+    ADD COLUMN deletion_articles ENUM('delete', 'reassign') NULL,
+    -- placeholder accounts only exist to own content, nobody can sign in as
+    -- them because their password is empty
+    ADD COLUMN placeholder BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD INDEX idx_users_deletion_scheduled_at (deletion_scheduled_at);
+
+-- author of the articles whose author deleted their account and chose to
+-- keep them
+INSERT INTO users (username, password, role, placeholder) VALUES ('[deleted]', '', 'reader', TRUE);
@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN suspended_at DATETIME NULL,
+    ADD COLUMN suspension_reason VARCHAR(500) NOT NULL DEFAULT '',
+    -- the admin that suspended the user
+    ADD COLUMN suspended_by INT NULL;
@@ -0,0 +1,21 @@
+-- security relevant things that happened to accounts, rows are only ever
+-- inserted
+CREATE TABLE audit_events (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event VARCHAR(64) NOT NULL,
+    outcome ENUM('success', 'failure') NOT NULL,
+    -- the account the event is about, NULL when a sign in names an unknown
+    -- username
+    user_id INT NULL,
+    -- who did it, only differs from user_id for admin actions
+    actor_id INT NULL,
+    -- the username as it was sent, kept for sign ins of unknown usernames
+    username VARCHAR(255) NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    INDEX idx_audit_events_created_at (created_at),
+    INDEX idx_audit_events_user_id (user_id, created_at),
+    INDEX idx_audit_events_event (event, created_at)
+);